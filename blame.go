@@ -0,0 +1,26 @@
+package main
+
+// entangle blame: who wrote what
+
+import (
+	"fmt"
+	"time"
+)
+
+// blameCommand prints the document recorded in a journal span by span, along with the
+// site that wrote every span and when.
+func blameCommand(args []string) {
+	fs, walPath := journalFlags("blame", "Prints the document span by span, with the site that wrote every span and when.")
+	d := readJournal(fs, args, walPath)
+
+	for _, s := range d.Blame() {
+		author, when := "initial", ""
+		if s.Site != 0 {
+			author = fmt.Sprintf("site %d", s.Site)
+		}
+		if !s.Time.IsZero() {
+			when = s.Time.Format(time.RFC3339)
+		}
+		fmt.Printf("%6d  %-8s  %-20s  %q\n", s.Offset, author, when, s.Text)
+	}
+}
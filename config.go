@@ -0,0 +1,349 @@
+package main
+
+// the settings of a peer: flags, a config file and environment variables
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/node"
+)
+
+// how often documents are compared with peers, by default
+const antiEntropyEvery = 10 * time.Second
+
+// envPrefix starts the environment variables that override settings: ENTANGLE_LISTEN
+// for -listen, ENTANGLE_TLS_CERT for -tls-cert, and so on.
+const envPrefix = "ENTANGLE_"
+
+// settings of a peer. Every setting is a flag, and has the same name in the config
+// file.
+type settings struct {
+	config string
+
+	listen string
+	site   uint
+	peers  addrList
+
+	data  string
+	wal   string
+	fsync bool
+
+	transport               string
+	tlsCert, tlsKey, tlsCA  string
+	timeout                 time.Duration
+	batchOps, snapshotOps   int
+	batchDelay, antiEntropy time.Duration
+	snapshotEvery           time.Duration
+
+	logFile string
+	quiet   bool
+	control string
+}
+
+// addrList is a comma-separated list of addresses.
+type addrList []string
+
+func (l *addrList) String() string { return strings.Join(*l, ",") }
+
+func (l *addrList) Set(s string) error {
+	*l = nil
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			*l = append(*l, addr)
+		}
+	}
+	return nil
+}
+
+// flags returns the flag set of the settings.
+func (s *settings) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&s.config, "config", "", "JSON file of settings, named like the flags")
+	fs.StringVar(&s.listen, "listen", "", "address to listen at, host:port")
+	fs.UintVar(&s.site, "site", 0, "site ID, 1 to 255 (default numbers the peers by address)")
+	fs.Var(&s.peers, "peers", "comma-separated addresses of the other peers")
+	fs.StringVar(&s.data, "data", ".", "directory of the write-ahead log and the snapshots")
+	fs.StringVar(&s.wal, "wal", "", "write-ahead log of the document (default <data>/entangle-<listen>.wal)")
+	fs.BoolVar(&s.fsync, "fsync", true, "sync the write-ahead log to disk before acknowledging operations")
+	fs.IntVar(&s.snapshotOps, "snapshot-ops", 10000, "operations between two snapshots of the document, 0 for none")
+	fs.DurationVar(&s.snapshotEvery, "snapshot-every", 10*time.Minute, "time between two snapshots of the document, 0 for none")
+	fs.StringVar(&s.transport, "transport", "framed", "protocol to send operations with: framed, or rpc for peers that only speak net/rpc")
+	fs.StringVar(&s.tlsCert, "tls-cert", "", "PEM certificate to secure connections with TLS")
+	fs.StringVar(&s.tlsKey, "tls-key", "", "PEM private key of -tls-cert")
+	fs.StringVar(&s.tlsCA, "tls-ca", "", "PEM certificates peers must be signed by, on both sides (default the system ones, servers do not check)")
+	fs.DurationVar(&s.timeout, "timeout", 10*time.Second, "time a call to a peer may take")
+	fs.IntVar(&s.batchOps, "batch-ops", 256, "most operations sent to a peer in one call")
+	fs.DurationVar(&s.batchDelay, "batch-delay", 10*time.Millisecond, "time operations wait for others to be sent with")
+	fs.DurationVar(&s.antiEntropy, "anti-entropy", antiEntropyEvery, "time between two comparisons of the document with the peers, 0 for none")
+	fs.StringVar(&s.logFile, "log-file", "", "file to append the log to (default standard error)")
+	fs.BoolVar(&s.quiet, "quiet", false, "log nothing")
+	fs.StringVar(&s.control, "control", "", "unix socket of the control API, for the peers command (default <data>/entangle-<listen>.sock)")
+	return fs
+}
+
+// loadSettings reads the settings from, by increasing priority, the defaults, the config
+// file, the environment and the command line, then hands the arguments left after the
+// flags to rest. synopsis is the command and its arguments, for the usage message.
+func loadSettings(synopsis string, args []string, rest func(s *settings, args []string) error) (*settings, error) {
+	s := new(settings)
+	fs := s.flags()
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s\n\n", os.Args[0], synopsis)
+		fmt.Fprintf(out, "Every option may also be set in the -config file, or in an environment variable\nnamed like %sLISTEN for -listen.\n\n", envPrefix)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args) // for -config
+	if s.config == "" {
+		s.config = os.Getenv(envPrefix + "CONFIG")
+	}
+	if s.config != "" {
+		if err := applyFile(fs, s.config); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+	fs.Parse(args) // the command line wins
+
+	if err := rest(s, fs.Args()); err != nil {
+		fs.Usage()
+		return nil, err
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// applyFile sets the flags named in a JSON config file.
+func applyFile(fs *flag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		var v string
+		switch value := values[name].(type) {
+		case string:
+			v = value
+		case bool:
+			v = strconv.FormatBool(value)
+		case float64:
+			v = strconv.FormatFloat(value, 'f', -1, 64)
+		case []interface{}:
+			list := make([]string, len(value))
+			for i, e := range value {
+				if list[i], _ = e.(string); list[i] == "" {
+					return fmt.Errorf("%s: %s: want a list of strings", path, name)
+				}
+			}
+			v = strings.Join(list, ",")
+		default:
+			return fmt.Errorf("%s: %s: unexpected %v", path, name, value)
+		}
+		if err := f.Value.Set(v); err != nil {
+			return fmt.Errorf("%s: %s: invalid value %q: %v", path, name, v, err)
+		}
+	}
+	return nil
+}
+
+// applyEnv sets the flags that have an environment variable.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if v, ok := os.LookupEnv(name); ok && err == nil && f.Name != "config" {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("$%s: invalid value %q: %v", name, v, e)
+			}
+		}
+	})
+	return err
+}
+
+// positional reads the arguments of the old form [ip:port] [N-clients] [ip1:port] ...
+// [ipN:port], still accepted. The number of clients is not used.
+func (s *settings) positional(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if s.listen != "" || len(s.peers) > 0 || len(args) < 3 {
+		return errors.New("unexpected arguments: " + strings.Join(args, " "))
+	}
+	log.Printf("positional arguments are deprecated, use -listen %s -peers %s", args[0], strings.Join(args[2:], ","))
+	if n, err := strconv.Atoi(args[1]); err != nil || n != len(args)-2 {
+		log.Printf("ignoring the number of clients %s, there are %d peers", args[1], len(args)-2)
+	}
+	s.listen, s.peers = args[0], args[2:]
+	return nil
+}
+
+// validate checks the settings, and reports all that is wrong with them at once.
+func (s *settings) validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if s.listen == "" {
+		problem("-listen: missing, say which address to listen at")
+	} else if err := checkAddr(s.listen); err != nil {
+		problem("-listen: %v", err)
+	}
+	if s.site > 255 {
+		problem("-site: %d is not a site ID, they go from 1 to 255", s.site)
+	}
+	seen := map[string]bool{s.listen: true}
+	for _, p := range s.peers {
+		if err := checkAddr(p); err != nil {
+			problem("-peers: %v", err)
+		} else if seen[p] {
+			problem("-peers: %s is listed twice, or is the address of this peer", p)
+		}
+		seen[p] = true
+	}
+	if len(s.peers) > 254 {
+		problem("-peers: %d peers, a session has 255 at most", len(s.peers))
+	}
+
+	if s.transport != "framed" && s.transport != "rpc" {
+		problem("-transport: %q, want framed or rpc", s.transport)
+	}
+	if (s.tlsCert == "") != (s.tlsKey == "") {
+		problem("-tls-cert and -tls-key: both are needed for TLS")
+	}
+	if s.tlsCA != "" && s.tlsCert == "" {
+		problem("-tls-ca: peers check each other with it, so -tls-cert is needed too")
+	}
+
+	if s.batchOps < 1 {
+		problem("-batch-ops: %d, at least one operation has to fit in a batch", s.batchOps)
+	}
+	if s.snapshotOps < 0 {
+		problem("-snapshot-ops: %d, want 0 or more", s.snapshotOps)
+	}
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{{"batch-delay", s.batchDelay}, {"snapshot-every", s.snapshotEvery}, {"timeout", s.timeout}, {"anti-entropy", s.antiEntropy}} {
+		if d.d < 0 {
+			problem("-%s: %v, want 0 or more", d.name, d.d)
+		}
+	}
+	if fi, err := os.Stat(s.data); err == nil && !fi.IsDir() {
+		problem("-data: %s is not a directory", s.data)
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid settings:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// checkAddr checks that addr is a host:port pair.
+func checkAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%s: bad port %q", addr, port)
+	}
+	return nil
+}
+
+// setup opens the log and the data directory, and returns the configuration of the
+// node.
+func (s *settings) setup() (node.Config, error) {
+	if err := os.MkdirAll(s.data, 0755); err != nil {
+		return node.Config{}, err
+	}
+	switch {
+	case s.quiet:
+		log.SetOutput(io.Discard)
+	case s.logFile != "":
+		f, err := os.OpenFile(s.logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return node.Config{}, err
+		}
+		log.SetOutput(f)
+	}
+	cfg := node.Config{
+		Addr:          s.listen,
+		Peers:         s.peers,
+		Site:          uint8(s.site),
+		Journal:       s.wal,
+		Sync:          s.fsync,
+		SnapshotOps:   s.snapshotOps,
+		SnapshotEvery: s.snapshotEvery,
+		BatchOps:      s.batchOps,
+		BatchDelay:    s.batchDelay,
+		Timeout:       s.timeout,
+		LegacyRPC:     s.transport == "rpc",
+		AntiEntropy:   s.antiEntropy,
+	}
+	if cfg.Journal == "" {
+		cfg.Journal = filepath.Join(s.data, node.DefaultJournal(s.listen))
+	}
+	if s.control == "" {
+		s.control = filepath.Join(s.data, controlSocket(s.listen))
+	}
+	if s.tlsCert != "" {
+		var err error
+		if cfg.TLS, err = s.tlsConfig(); err != nil {
+			return node.Config{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// tlsConfig loads the certificates of the TLS settings.
+func (s *settings) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.tlsCert, s.tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("-tls-cert: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if s.tlsCA != "" {
+		pem, err := os.ReadFile(s.tlsCA)
+		if err != nil {
+			return nil, fmt.Errorf("-tls-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-tls-ca: no certificate in %s", s.tlsCA)
+		}
+		cfg.RootCAs, cfg.ClientCAs, cfg.ClientAuth = pool, pool, tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
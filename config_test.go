@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestLoadSettings(t *testing.T) {
+	type want struct {
+		Listen   string
+		Peers    []string
+		Site     uint
+		BatchOps int
+		Timeout  time.Duration
+		Fsync    bool
+	}
+	defaults := want{Listen: "127.0.0.1:7000", BatchOps: 256, Timeout: 10 * time.Second, Fsync: true}
+	with := func(f func(w *want)) want {
+		w := defaults
+		f(&w)
+		return w
+	}
+
+	for _, c := range []struct {
+		name string
+		file string            // config file, passed with -config unless env sets it
+		env  map[string]string // environment variables
+		args []string
+		want want
+		err  []string // parts of the error, if any
+	}{{
+		name: "defaults",
+		args: []string{"-listen", "127.0.0.1:7000"},
+		want: defaults,
+	}, {
+		name: "file over defaults",
+		file: `{"listen": "127.0.0.1:7000", "peers": ["127.0.0.1:7001", "127.0.0.1:7002"], "batch-ops": 8, "fsync": false, "timeout": "1s"}`,
+		want: with(func(w *want) {
+			w.Peers, w.BatchOps, w.Fsync, w.Timeout = []string{"127.0.0.1:7001", "127.0.0.1:7002"}, 8, false, time.Second
+		}),
+	}, {
+		name: "environment over file",
+		file: `{"listen": "127.0.0.1:7000", "batch-ops": 8, "site": 3}`,
+		env:  map[string]string{"ENTANGLE_BATCH_OPS": "16", "ENTANGLE_PEERS": "127.0.0.1:7001, 127.0.0.1:7002"},
+		want: with(func(w *want) { w.Peers, w.BatchOps, w.Site = []string{"127.0.0.1:7001", "127.0.0.1:7002"}, 16, 3 }),
+	}, {
+		name: "flags over environment",
+		file: `{"listen": "127.0.0.1:7000", "batch-ops": 8}`,
+		env:  map[string]string{"ENTANGLE_BATCH_OPS": "16", "ENTANGLE_SITE": "4"},
+		args: []string{"-batch-ops", "32"},
+		want: with(func(w *want) { w.BatchOps, w.Site = 32, 4 }),
+	}, {
+		name: "file from the environment",
+		file: `{"listen": "127.0.0.1:7000", "batch-ops": 8}`,
+		env:  map[string]string{"ENTANGLE_CONFIG": ""}, // set to the file
+		want: with(func(w *want) { w.BatchOps = 8 }),
+	}, {
+		name: "positional arguments",
+		args: []string{"127.0.0.1:7000", "2", "127.0.0.1:7001"},
+		want: with(func(w *want) { w.Peers = []string{"127.0.0.1:7001"} }),
+	}, {
+		name: "unknown key",
+		file: `{"listen": "127.0.0.1:7000", "lisen": "127.0.0.1:7001"}`,
+		err:  []string{`unknown setting "lisen"`},
+	}, {
+		name: "config in the file",
+		file: `{"config": "other.json"}`,
+		err:  []string{`unknown setting "config"`},
+	}, {
+		name: "bad file value",
+		file: `{"site": "first"}`,
+		err:  []string{"site: invalid value \"first\""},
+	}, {
+		name: "bad environment value",
+		env:  map[string]string{"ENTANGLE_TIMEOUT": "soon"},
+		args: []string{"-listen", "127.0.0.1:7000"},
+		err:  []string{`$ENTANGLE_TIMEOUT: invalid value "soon"`},
+	}, {
+		name: "everything wrong at once",
+		env:  map[string]string{"ENTANGLE_TRANSPORT": "pigeon"},
+		args: []string{"-listen", "nowhere", "-site", "300", "-peers", "127.0.0.1:7001,127.0.0.1:7001", "-batch-ops", "0", "-timeout", "-1s", "-tls-key", "key.pem"},
+		err: []string{
+			"invalid settings:\n  -listen: ",
+			"\n  -site: 300 is not a site ID",
+			"\n  -peers: 127.0.0.1:7001 is listed twice",
+			"\n  -transport: \"pigeon\", want framed or rpc",
+			"\n  -tls-cert and -tls-key: both are needed",
+			"\n  -batch-ops: 0",
+			"\n  -timeout: -1s, want 0 or more",
+		},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			args := c.args
+			if c.file != "" {
+				path := filepath.Join(t.TempDir(), "peer.json")
+				assert.NilError(t, os.WriteFile(path, []byte(c.file), 0644))
+				if _, ok := c.env["ENTANGLE_CONFIG"]; ok {
+					t.Setenv("ENTANGLE_CONFIG", path)
+				} else {
+					args = append([]string{"-config", path}, args...)
+				}
+			}
+			for name, v := range c.env {
+				if name != "ENTANGLE_CONFIG" {
+					t.Setenv(name, v)
+				}
+			}
+
+			s, err := loadSettings("serve", args, (*settings).positional)
+			if len(c.err) > 0 {
+				assert.Assert(t, err != nil)
+				for _, part := range c.err {
+					assert.Assert(t, strings.Contains(err.Error(), part), "%q in %q", part, err)
+				}
+				return
+			}
+			assert.NilError(t, err)
+			got := want{Listen: s.listen, Peers: []string(s.peers), Site: s.site, BatchOps: s.batchOps, Timeout: s.timeout, Fsync: s.fsync}
+			assert.DeepEqual(t, got, c.want)
+		})
+	}
+}
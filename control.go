@@ -0,0 +1,92 @@
+package main
+
+// the control API of a running peer: HTTP on a unix socket next to its journal
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/node"
+)
+
+// status is what the control API tells about a peer.
+type status struct {
+	Addr  string   `json:"addr"`
+	Site  uint8    `json:"site"`
+	Peers []string `json:"peers"` // the other members of the session
+}
+
+// controlSocket returns the control socket of the peer listening at addr.
+func controlSocket(addr string) string {
+	return strings.TrimSuffix(node.DefaultJournal(addr), ".wal") + ".sock"
+}
+
+// serveControl serves the control API of n at path until it is closed. A socket left
+// there by a peer that crashed is replaced, one that a peer still listens to is not.
+func serveControl(path, addr string, n *node.Node) (io.Closer, error) {
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s: another peer is running", path)
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status{Addr: addr, Site: n.SiteID(), Peers: n.Peers()})
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	return srv, nil
+}
+
+// peersCommand lists the members of the session of a running peer.
+func peersCommand(args []string) {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	control := fs.String("control", "", "control socket of the peer (default <data>/entangle-<ip:port>.sock)")
+	data := fs.String("data", ".", "data directory of the peer")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s peers [options] [ip:port]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *control == "" {
+		*control = peerFile(fs, *data, controlSocket)
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", *control)
+		}},
+	}
+	resp, err := client.Get("http://entangle/peers")
+	checkError(err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		checkError(fmt.Errorf("%s: %s", *control, resp.Status))
+	}
+	var st status
+	checkError(json.NewDecoder(resp.Body).Decode(&st))
+	fmt.Printf("%s  site %d (this peer)\n", st.Addr, st.Site)
+	for _, p := range st.Peers {
+		fmt.Println(p)
+	}
+}
@@ -0,0 +1,60 @@
+package document
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// allocate generates n positions with GeneratePos alone, each between the neighbours
+// pick chooses among the positions so far, and returns them in order. Positions that
+// come out of order are dropped and counted in bad.
+func allocate(n int, pick func(len int) int) (positions [][]Identifier, bad int) {
+	positions = [][]Identifier{Start, End}
+	for i := 0; i < n; i++ {
+		at := pick(len(positions)) // the new position goes before positions[at]
+		lp, rp := positions[at-1], positions[at]
+		p, ok := GeneratePos(lp, rp, 1)
+		if !ok || ComparePos(lp, p) != -1 || ComparePos(p, rp) != -1 {
+			bad++
+			continue
+		}
+		positions = append(positions[:at], append([][]Identifier{p}, positions[at:]...)...)
+	}
+	return positions, bad
+}
+
+// BenchmarkAllocatorDepth reports how deep the positions GeneratePos makes get, for the
+// ways text is typed, without the rest of Document. It only uses what the allocator
+// has always had, so it also runs against older versions of it.
+func BenchmarkAllocatorDepth(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	patterns := []struct {
+		name string
+		pick func(len int) int
+	}{
+		{"end", func(len int) int { return len - 1 }},
+		{"front", func(len int) int { return 1 }},
+		{"middle", func(len int) int { return len / 2 }},
+		{"random", func(len int) int { return rng.Intn(len-1) + 1 }},
+	}
+	for _, pattern := range patterns {
+		b.Run(fmt.Sprint(pattern.name, "/", 10000), func(b *testing.B) {
+			var positions [][]Identifier
+			var bad int
+			for i := 0; i < b.N; i++ {
+				positions, bad = allocate(10000, pattern.pick)
+			}
+			total, max := 0, 0
+			for _, p := range positions {
+				total += len(p)
+				if len(p) > max {
+					max = len(p)
+				}
+			}
+			b.ReportMetric(float64(total)/float64(len(positions)), "ids/pos")
+			b.ReportMetric(float64(max), "max-ids/pos")
+			b.ReportMetric(float64(bad), "out-of-order")
+		})
+	}
+}
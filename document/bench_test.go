@@ -0,0 +1,160 @@
+package document
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var benchSizes = []int{1000, 10000}
+
+// typeSequential types n characters at the end of a new document, the way a user
+// writes a fresh text.
+func typeSequential(n int) *Document {
+	d := NewDocument(nil, 1)
+	for i := 0; i < n; i++ {
+		d.InsertLeft(End, "a")
+	}
+	return d
+}
+
+// typeRandom inserts n characters at random places of a new document.
+func typeRandom(n int, rng *rand.Rand) *Document {
+	d := NewDocument(nil, 1)
+	for i := 0; i < n; i++ {
+		d.InsertLeft(d.pairs[rng.Intn(len(d.pairs)-1)+1].pos, "a")
+	}
+	return d
+}
+
+// reportDepth reports the average and maximum number of identifiers per position of d.
+func reportDepth(b *testing.B, d *Document) {
+	total, max := 0, 0
+	for _, e := range d.pairs {
+		total += len(e.pos)
+		if len(e.pos) > max {
+			max = len(e.pos)
+		}
+	}
+	b.ReportMetric(float64(total)/float64(len(d.pairs)), "ids/pos")
+	b.ReportMetric(float64(max), "max-ids/pos")
+}
+
+func BenchmarkSequentialTyping(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			var d *Document
+			for i := 0; i < b.N; i++ {
+				d = typeSequential(n)
+			}
+			reportDepth(b, d)
+		})
+	}
+}
+
+func BenchmarkRandomTyping(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			rng := rand.New(rand.NewSource(1))
+			var d *Document
+			for i := 0; i < b.N; i++ {
+				d = typeRandom(n, rng)
+			}
+			reportDepth(b, d)
+		})
+	}
+}
+
+func BenchmarkBigPaste(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			paste := bytes.Repeat([]byte("x"), n)
+			var d *Document
+			for i := 0; i < b.N; i++ {
+				d = NewDocument([]string{"a", "b"}, 1)
+				d.insertMultiple(d.pairs[1].pos, paste)
+			}
+			reportDepth(b, d)
+		})
+	}
+}
+
+func BenchmarkBulkDelete(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			src := typeSequential(n)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				d := &Document{clientID: 2, pairs: append([]pair(nil), src.pairs...)}
+				b.StartTimer()
+				for len(d.pairs) > 2 { // one remote delete per character
+					d.delete(d.pairs[1].pos)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkContent(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			d := typeRandom(n, rand.New(rand.NewSource(1)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.Content()
+			}
+		})
+	}
+}
+
+func BenchmarkIndex(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			d := typeRandom(n, rand.New(rand.NewSource(1)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.Index(d.pairs[i%len(d.pairs)].pos)
+			}
+			reportDepth(b, d)
+		})
+	}
+}
+
+func BenchmarkSnapshotEncode(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			d := typeRandom(n, rand.New(rand.NewSource(1)))
+			d.TakeOps() // peers take them as they come, they are not kept for snapshots
+			b.ReportAllocs()
+			b.ResetTimer()
+			var enc []byte
+			for i := 0; i < b.N; i++ {
+				enc, _ = d.MarshalBinary()
+			}
+			b.ReportMetric(float64(len(enc))/float64(n), "bytes/char")
+		})
+	}
+}
+
+func BenchmarkSnapshotDecode(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			enc, _ := typeRandom(n, rand.New(rand.NewSource(1))).MarshalBinary()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var d Document
+				if err := d.UnmarshalBinary(enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
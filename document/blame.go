@@ -0,0 +1,36 @@
+package document
+
+import "time"
+
+// Span is a run of characters of the Document written by the same site.
+type Span struct {
+	Offset int    // index of the first character of the span in Content
+	Text   string // the characters of the span
+	Site   uint8  // the site that inserted them, 0 for content that did not come from an Op
+	Clock  uint64 // clock of the latest insert of the span at that site
+	Time   time.Time
+}
+
+// Blame returns who wrote the Document: the spans of characters inserted by the same
+// site, in order, with the clock and the time of the latest insert of every span. The
+// time is zero when the insert is not in the history.
+func (d *Document) Blame() []Span {
+	var spans []Span
+	offset := 0
+	for _, e := range d.pairs[1 : len(d.pairs)-1] {
+		if n := len(spans); n == 0 || spans[n-1].Site != e.id.Site {
+			spans = append(spans, Span{Offset: offset, Site: e.id.Site})
+		}
+		s := &spans[len(spans)-1]
+		s.Text += e.atom
+		offset += len(e.atom)
+		if e.id.Clock < s.Clock {
+			continue
+		}
+		s.Clock = e.id.Clock
+		if op, ok := d.HistoryOp(e.id); ok && op.Time != 0 {
+			s.Time = time.Unix(0, op.Time)
+		}
+	}
+	return spans
+}
@@ -0,0 +1,40 @@
+package document
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestBlame(t *testing.T) {
+	doc1 := NewDocument(strings.Split("Entangle", ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	assert.DeepEqual(t, doc1.Blame(), []Span{{Offset: 0, Text: "Entangle"}})
+
+	p, _ := doc1.InsertLeft(End, " ")
+	doc1.InsertRight(p, "!")
+	q, _ := doc2.InsertRight(Start, "a")
+	doc2.InsertRight(q, "n")
+	t2 := time.Date(2020, 5, 17, 0, 0, 0, 0, time.UTC)
+	for _, op := range doc2.TakeOps() {
+		op.Time = t2.UnixNano()
+		doc1.Apply(op)
+	}
+	doc1.DeleteRight(doc1.pairs[2].pos) // "E" of the initial content
+
+	spans := doc1.Blame()
+	assert.Equal(t, doc1.Content(), "anntangle !")
+	assert.Equal(t, len(spans), 3)
+	assert.DeepEqual(t, spans[0], Span{Offset: 0, Text: "an", Site: 2, Clock: 2, Time: time.Unix(0, t2.UnixNano())})
+	assert.DeepEqual(t, spans[1], Span{Offset: 2, Text: "ntangle"})
+	assert.Equal(t, spans[2].Offset, 9)
+	assert.Equal(t, spans[2].Text, " !")
+	assert.Equal(t, spans[2].Site, uint8(1))
+	assert.Equal(t, spans[2].Clock, uint64(2))
+	assert.Assert(t, !spans[2].Time.IsZero())
+}
@@ -2,8 +2,8 @@ package document
 
 import (
 	"bytes"
-	"fmt"
-	"math/rand"
+	"encoding/binary"
+	"time"
 )
 
 // Adapted from Ravern Koh's implementation
@@ -11,8 +11,50 @@ import (
 // on Document. If at any time an invalid position is given, a panic will occur, so raw
 // positions should only be used for debugging purposes.
 type Document struct {
-	clientID uint8
-	pairs    []pair
+	clientID   uint8
+	pairs      []pair
+	tombstones map[string]tombstone // deleted positions, keyed by PosBytes
+
+	clock   uint64                  // number of operations issued by this site
+	version VersionVector           // operations applied here, without gaps
+	ahead   map[OpID]bool           // operations applied here past a gap in version
+	peers   map[uint8]VersionVector // last version vector known for every other site
+	outbox  []Op                    // local operations not taken for broadcast yet
+	retired map[uint64]bool         // hashes of collected positions this site generated
+	gc      GCStats
+	sinceGC int // operations applied since the last garbage collection
+
+	ids       int           // number of identifiers over all positions, for the average depth
+	epoch     uint32        // number of rebalances applied
+	prev      *layout       // how the previous epoch was rebalanced into this one
+	deferred  []Op          // operations of a later epoch, waiting for its rebalance
+	rebalance OpID          // the last rebalance applied
+	bounds    VersionVector // per site, a clock covering its operations of the previous epoch
+	maxDepth  float64       // average depth that triggers a rebalance, 0 never does
+	dropped   int           // operations of peers too old to translate, see Dropped
+
+	log   []Op          // applied operations, in the order they were applied, for delta sync
+	floor VersionVector // operations dropped from log because every site has them
+
+	merkle []uint64 // digests of the Merkle tree over pairs, see Digest
+
+	history []Op         // every operation applied, in the order it was applied
+	indexed map[OpID]int // index of every operation in history
+	base    []pair       // pairs not inserted through an Op, in the order they were inserted
+	frozen  bool         // a past state, see At
+
+	undo, redo [][]edit  // units of local edits, latest last, see Undo
+	lastEdit   time.Time // when the last local edit was tracked
+	closed     bool      // the next local edit starts a new undo unit
+	reverting  bool      // edits are being undone or redone
+	pending    []edit    // edits left to undo or redo
+	reverted   []edit    // edits that undid or redid them so far
+
+	txn      int              // number of Begin calls not committed yet
+	staged   []Op             // local operations of the open group
+	partial  map[OpID][]Op    // operations of incomplete remote groups, by group
+	watchers []func(ops []Op) // called with every change, see Watch
+	quiet    bool             // changes are reported later, as one
 }
 
 // Pos is an element of a position identifier. A position identifier identifies an
@@ -27,7 +69,16 @@ type Identifier struct {
 type pair struct {
 	pos  []Identifier // a position is a list of identifiers
 	atom string       // this is actually a char, but stick to string for easy future extension to string-wise
+	id   OpID         // the insert that created the pair, zero for content not inserted through an Op
+}
 
+// tombstone remembers a deleted position. A delete may reach a peer before the insert
+// it removes, and an insert may be delivered twice, so inserts of tombstoned positions
+// are ignored. This makes inserts and deletes commute under any delivery order.
+type tombstone struct {
+	pos  []Identifier
+	id   OpID // the delete that created the tombstone
+	seen bool // whether the insert of pos was seen here, so later copies of it are duplicates
 }
 
 // Start and end positions. These will always exist within a Documentument.
@@ -38,19 +89,27 @@ var (
 
 // New creates a new Document containing the given content and a clientID
 func NewDocument(content []string, clientID uint8) *Document {
-	d := &Document{clientID: clientID} // local variable? stored in stack?
+	d := &Document{clientID: clientID, maxDepth: DefaultRebalanceDepth} // local variable? stored in stack?
 	// Note that, unlike in C, it's perfectly OK to return the address of a local variable;
 	// the storage associated with the variable survives after the function returns.
 	d.insert(Start, "")
 	d.insert(End, "")
 	for _, c := range content {
-		// End will always exist.
-		d.InsertLeft(End, c)
+		// End will always exist. Initial content is not an operation, peers get it by
+		// copying the document.
+		lp, _ := d.Left(End)
+		np, _ := d.GeneratePos(lp, End)
+		d.insert(np, c)
 	}
 	d.clientID = clientID
 	return d
 }
 
+// SiteID returns the site the Document issues operations as.
+func (d *Document) SiteID() uint8 {
+	return d.clientID
+}
+
 /* Basic methods */
 
 // Index of a position in the Document. Secondary value indicates whether the value exists.
@@ -111,15 +170,49 @@ func (d *Document) Get(p []Identifier) (string, bool) {
 	return d.pairs[i].atom, true
 }
 
+// Pos returns the position of the i-th atom, counting from 1, so that Pos(0) is Start
+// and Pos(n+1) is End for a Document of n atoms. Secondary return value indicates
+// whether there is such a position.
+func (d *Document) Pos(i int) ([]Identifier, bool) {
+	if i < 0 || i >= len(d.pairs) {
+		return nil, false
+	}
+	return d.pairs[i].pos, true
+}
+
+// Entries returns every pair of the Document in order, Start and End included, for
+// debugging.
+func (d *Document) Entries() []Entry {
+	entries := make([]Entry, len(d.pairs))
+	for i, e := range d.pairs {
+		entries[i] = Entry{Pos: e.pos, Atom: e.atom, ID: e.id}
+	}
+	return entries
+}
+
 // Insert a new pair at the position, returning success or failure (already existing
-// position). Note that atom is a single byte to insert
+// or already deleted position). Note that atom is a single byte to insert
 func (d *Document) insert(p []Identifier, atom string) bool {
-	i, exists := d.Index(p)
+	return d.insertPair(pair{pos: p, atom: atom})
+}
+
+// insertPair inserts e, see insert.
+func (d *Document) insertPair(e pair) bool {
+	if t, dead := d.tombstones[string(PosBytes(e.pos))]; dead {
+		t.seen = true
+		d.tombstones[string(PosBytes(e.pos))] = t
+		return false
+	}
+	i, exists := d.Index(e.pos)
 	if exists {
 		return false
 	}
 	// this is harmful for rach condition
-	d.pairs = append(d.pairs[0:i], append([]pair{{p, atom}}, d.pairs[i:]...)...)
+	d.pairs = append(d.pairs[0:i], append([]pair{e}, d.pairs[i:]...)...)
+	d.added(e)
+	if e.id.Clock == 0 {
+		d.base = append(d.base, e)
+	}
 	return true
 }
 
@@ -149,11 +242,26 @@ func (d *Document) insertMultiple(p []Identifier, value []byte) bool {
 }
 
 // Delete the pair at the position, returning success or failure (non-existent position).
+// The position is tombstoned even when it does not exist yet, so that its insert, when
+// it arrives, is ignored.
 func (d *Document) delete(p []Identifier) bool {
+	return d.deleteID(p, OpID{}, OpID{})
+}
+
+// deleteID deletes the pair at the position on behalf of the delete operation id, see
+// delete. target is the insert that created the pair.
+func (d *Document) deleteID(p []Identifier, id, target OpID) bool {
+	if ComparePos(p, Start) == 0 || ComparePos(p, End) == 0 {
+		return false
+	}
 	i, exists := d.Index(p)
-	if !exists || i == 0 || i == len(d.pairs)-1 {
+	// Initial content has no insert to wait for. A pair that is gone although its
+	// insert was applied has been deleted concurrently and its tombstone collected.
+	d.bury(p, id, exists || target.Clock == 0 || d.applied(target))
+	if !exists {
 		return false
 	}
+	d.removed(d.pairs[i])
 	d.pairs = append(d.pairs[0:i], d.pairs[i+1:]...)
 	return true
 }
@@ -166,10 +274,41 @@ func (d *Document) deleteMultiple(startIndex, endIndex int) bool {
 		return false
 	}
 
+	d.Begin()
+	defer d.Commit()
+	after := d.pairs[startIndex-1].pos
+	for _, e := range d.pairs[startIndex:endIndex] {
+		d.removed(e)
+		d.bury(e.pos, d.nextID(), true)
+		d.record(Op{Kind: DeleteOp, Epoch: d.epoch, Pos: e.pos, Target: e.id})
+		d.track(edit{kind: DeleteOp, pos: e.pos, atom: e.atom, after: after})
+	}
 	d.pairs = append(d.pairs[0:startIndex], d.pairs[endIndex:]...)
 	return true
 }
 
+// bury records a tombstone for the position, deleted by the operation id. A position
+// deleted twice keeps its first tombstone.
+func (d *Document) bury(p []Identifier, id OpID, seen bool) {
+	if d.tombstones == nil {
+		d.tombstones = make(map[string]tombstone)
+	}
+	k := string(PosBytes(p))
+	if t, dead := d.tombstones[k]; dead {
+		t.seen = t.seen || seen
+		d.tombstones[k] = t
+		return
+	}
+	d.tombstones[k] = tombstone{pos: p, id: id, seen: seen}
+}
+
+// deleted reports whether the position has been deleted, whether or not it was ever
+// inserted here.
+func (d *Document) deleted(p []Identifier) bool {
+	_, dead := d.tombstones[string(PosBytes(p))]
+	return dead
+}
+
 // Left returns the position to the left of the given position, and a flag indicating
 // whether it exists (when the given position is the start, there is no position to the
 // left of it). Will be false if the given position is invalid. The Start pair is not
@@ -194,143 +333,106 @@ func (d *Document) Right(p []Identifier) ([]Identifier, bool) {
 	return d.pairs[i+1].pos, true
 }
 
-// random number between x and y, where y is greater than x.
-func random(x, y uint16) uint16 {
-	return uint16(rand.Intn(int(y-x-1))) + 1 + x
-}
+// boundary caps how far past the left neighbour a new identifier is placed. Keeping new
+// identifiers close to the left leaves room for the next keystroke, so sequential typing
+// stays on one level for a long time (the boundary+ strategy of LSEQ). The price is text
+// typed backwards, each character before the previous one, which uses a level up every
+// few characters; automatic rebalancing keeps that in check. BenchmarkAllocatorDepth
+// measures both.
+const boundary = 32
 
 // GeneratePos generates a new position identifier between the two positions provided.
 // Secondary return value indicates whether it was successful (when the two positions
-// are equal, or the left is greater than right, position cannot be generated).
-// Later will be optimized if time permits to LSEQ
+// are equal, or the left is greater than right, position cannot be generated). It also
+// fails when nothing fits in between, which only happens when rp is lp followed by
+// {0, 0} identifiers.
+//
+// The position is built level by level. As long as there is no identifier owned by site
+// strictly between the bounds of a level, the left bound is copied and the next level is
+// tried; once a new identifier fits, it ends the position. Because the last identifier
+// always carries site, two sites never generate the same position.
 func GeneratePos(lp, rp []Identifier, site uint8) ([]Identifier, bool) {
+	return generatePos(lp, rp, site, nil)
+}
+
+// generatePos is GeneratePos, skipping the positions taken reports, if it is not nil.
+// When every identifier that fits at a level is taken, the position goes one level
+// deeper below the first of them, where there is room again.
+func generatePos(lp, rp []Identifier, site uint8, taken func(p []Identifier) bool) ([]Identifier, bool) {
 	if ComparePos(lp, rp) != -1 { // lp should be less than rp
 		return nil, false
 	}
 	p := []Identifier{}
-	for i := 0; i < len(lp); i++ { // why len(lp)? could be len(rp)
-		l := lp[i]
-		r := rp[i]
-		if l.Ident == r.Ident && l.Site == r.Site { //all same, append
-			p = append(p, Identifier{l.Ident, l.Site})
-			continue
+	below := false // whether p is already less than rp, so rp no longer bounds it
+	above := false // whether p is already greater than lp, so lp no longer bounds it
+	for i := 0; ; i++ {
+		// unless above, p equals lp[:i], so lp bounds this level only while it has one
+		lo, hasLo := Identifier{}, !above && i < len(lp)
+		if hasLo {
+			lo = lp[i]
+		}
+		hi, hasHi := Identifier{}, !below && i < len(rp)
+		if hasHi {
+			hi = rp[i]
+		} else if !below { // p is rp plus something, which can only be greater
+			return nil, false
 		}
-		if d := r.Ident - l.Ident; d > 1 { // there are spaces in this level
-			r := random(l.Ident, r.Ident)
-			p = append(p, Identifier{r, site})
-		} else if d == 1 { // no space in this level
-			if site > l.Site { // if site is larger, TOTest:
-				p = append(p, Identifier{l.Ident, site})
-			} else if site < r.Site {
-				p = append(p, Identifier{r.Ident, site})
-			} else { // we now that rp[i] - lp[i] == 1 in this case, go through rest of lp to find a place to generate
-				// if lp[i+1] does not exist, then min := 0, else
-				min := uint16(0)
-				if len(lp) > i+1 {
-					min = lp[i+1].Ident // this should be lp[i+1].Ident
-				} // TODO: edge case need to check if min = max - 1
-				if len(lp) > len(rp) { // long lp, hard case
-					min = lp[len(rp)].Ident
-					// Super edge case
-					// left  => {3 1} {65534 1}
-					// right => {4 1}. some optimization can be made here, but stick it for now
-					// In this case, 65534 can't be min, because no number is in between
-					// it and MAX. So need to extend the positions further.
-					if min == ^uint16(0)-1 { // maxium is 65535, no space in lp's last level
-						r := random(0, ^uint16(0))
-						p = append(p, Identifier{l.Ident, l.Site}) // append previous
-						p = append(p, lp[len(rp):]...)
-						p = append(p, Identifier{r, site})
-						return p, true
-					}
-				} else if len(lp) < len(rp) { // lp is shorter
-					// lp is shorter
-					fmt.Println("lp is shorter case")
-				}
-				// need to take in account the case of min = ^uint16(0) - 1
-				var r uint16
-				if min == ^uint16(0)-1 {
-					r = ^uint16(0)
-				} else {
-					r = random(min, ^uint16(0))
-				}
-				//r := random(min, ^uint16(0)) // if min = ^uint16(0) - 1, then, need to append one more
-				p = append(p, Identifier{l.Ident, l.Site}, Identifier{r, site})
-			}
-		} else {
-			if site > l.Site && site < r.Site { //good case of three peers
-				p = append(p, Identifier{l.Ident, site})
-			} else {
-				min := uint16(0)
-				if len(lp) > i+1 {
-					min = lp[i+1].Ident // this should be lp[i+1].Ident
-				} // TODO: edge case need to check if min = max - 1
-				// special cases where there are no spaces oin this level
-				// which basically means we need to extend positions further
-				if len(lp) > len(rp) { // long lp, hard case
-					min = lp[len(rp)].Ident
-					// Super edge case
-					// left  => {3 1} {65534 1}
-					// right => {4 1}. some optimization can be made here, but stick it for now
-					// In this case, 65534 can't be min, because no number is in between
-					// it and MAX. So need to extend the positions further.
-					if min == ^uint16(0)-1 { // maxium is 65535, no space in lp's last level
-						r := random(0, ^uint16(0))
-						p = append(p, Identifier{l.Ident, l.Site}) // append previous
-						p = append(p, lp[len(rp):]...)
-						p = append(p, Identifier{r, site})
-						return p, true
-					}
-				} else if len(lp) < len(rp) {
-					// lp is shorter
-					fmt.Println("lp is shorter case")
-				}
-
-				// need to take in account the case of min = ^uint16(0) - 1
-				var r uint16
-				if min == ^uint16(0)-1 {
-					r = ^uint16(0)
-				} else {
-					r = random(min, ^uint16(0))
-				}
-
-				p = append(p, Identifier{l.Ident, l.Site}, Identifier{r, site})
 
+		// range of Ident such that lo < {Ident, site} < hi
+		min, max := 0, int(^uint16(0))
+		if hasLo {
+			min = int(lo.Ident)
+			if site <= lo.Site {
+				min++
+			}
+		}
+		if hasHi {
+			max = int(hi.Ident)
+			if site >= hi.Site {
+				max--
 			}
 		}
-		return p, true
-	}
-	var r uint16
-	if len(rp) > len(lp) { // easy case, make a random integer in new level
-		// TODO: need to account for cases where rp[len(lp)].Ident == 1
-		for i := len(lp); i < len(rp); i++ {
-			if rp[i].Ident == 1 {
-				r = 0
-				p = append(p, Identifier{r, site})
-				r := random(0, ^uint16(0))
-				p = append(p, Identifier{r, site})
-				return p, true
-			} else if rp[i].Ident == 0 {
-				// just append all the identifiers except the last
-				p = append(p, rp[i])
-				continue
-			} else {
-				r = random(0, rp[i].Ident)
-				p = append(p, Identifier{r, site})
-				return p, true
+		if min <= max {
+			if max-min > boundary {
+				max = min + boundary
 			}
-			//p = append(p, Identifier{r, site})
+			n := max - min + 1
+			start := rnd.Intn(n)
+			for k := 0; k < n; k++ {
+				np := append(p[:i:i], Identifier{uint16(min + (start+k)%n), site})
+				if taken == nil || !taken(np) {
+					return np, true
+				}
+			}
+			// all taken: any position starting with one of them is free and in between
+			p = append(p, Identifier{uint16(min), site})
+			above, below = true, true
+			continue
+		}
+
+		switch {
+		case hasLo: // follow lp one level deeper
+			p = append(p, lo)
+			below = below || lo != hi
+		case hi.Site > 0: // hi is {0, s} with s <= site, step just below it
+			p = append(p, Identifier{0, hi.Site - 1})
+			below = true
+		default: // hi is {0, 0}, nothing is smaller, follow rp
+			p = append(p, hi)
 		}
 	}
-	return p, true
 }
 
 // use this one when insert
 // GeneratePos generates a new position identifier between the two positions provided.
 // Secondary return value indicates whether it was successful (when the two positions
 // are equal, or the left is greater than right, position cannot be generated).
+// A deleted position is never handed out again, since its tombstone would swallow the
+// new atom.
 func (d *Document) GeneratePos(lp []Identifier, rp []Identifier) ([]Identifier, bool) {
-	return GeneratePos(lp, rp, d.clientID)
+	return generatePos(lp, rp, d.clientID, func(p []Identifier) bool {
+		return d.deleted(p) || d.wasRetired(p)
+	})
 }
 
 /* Convenience methods */
@@ -347,7 +449,7 @@ func (d *Document) InsertLeft(p []Identifier, atom string) ([]Identifier, bool)
 	if !success {
 		return nil, false
 	}
-	return np, d.insert(np, atom)
+	return np, d.insertLocal(np, atom)
 }
 
 // InsertRight inserts the atom to the right of the given position, returning the inserted
@@ -362,7 +464,7 @@ func (d *Document) InsertRight(p []Identifier, atom string) ([]Identifier, bool)
 	if !success {
 		return nil, false
 	}
-	return np, d.insert(np, atom)
+	return np, d.insertLocal(np, atom)
 }
 
 // DeleteLeft deletes the atom to the left of the given position, returning whether it
@@ -373,7 +475,7 @@ func (d *Document) DeleteLeft(p []Identifier) bool {
 	if !success {
 		return false
 	}
-	return d.delete(lp)
+	return d.deleteLocal(lp)
 }
 
 // DeleteRight deletes the atom to the right of the given position, returning whether it
@@ -384,7 +486,7 @@ func (d *Document) DeleteRight(p []Identifier) bool {
 	if !success {
 		return false
 	}
-	return d.delete(rp)
+	return d.deleteLocal(rp)
 }
 
 // Content of the entire Documentument.
@@ -407,9 +509,48 @@ func PosBytes(p []Identifier) []byte {
 	return b
 }
 
-// NewPos returns a position from the bytes. It doesn't validate the byte slice, so only
-// pass into it valid bytes.
+// PosVarint returns the position encoded like PosBytes, with the number of every
+// identifier as a uvarint instead of 2 bytes: from 1 byte for numbers below 128 to 3
+// for numbers from 16384.
+func PosVarint(p []Identifier) []byte {
+	b := []byte{byte(len(p))}
+	for _, c := range p {
+		b = binary.AppendUvarint(b, uint64(c.Ident))
+		b = append(b, c.Site)
+	}
+	return b
+}
+
+// NewPosVarint returns a position from the bytes, as produced by PosVarint, and the
+// number of bytes it took, nil for an empty position. Bytes after it are ignored. It
+// returns 0 bytes if b does not start with a position.
+func NewPosVarint(b []byte) ([]Identifier, int) {
+	if len(b) == 0 {
+		return nil, 0
+	}
+	count, n := int(b[0]), 1
+	if count == 0 {
+		return nil, 1
+	}
+	p := make([]Identifier, 0, count)
+	for i := 0; i < count; i++ {
+		ident, size := binary.Uvarint(b[n:])
+		if size <= 0 || ident > uint64(^uint16(0)) || n+size >= len(b) {
+			return nil, 0
+		}
+		n += size
+		p = append(p, Identifier{uint16(ident), b[n]})
+		n++
+	}
+	return p, n
+}
+
+// NewPos returns a position from the bytes, as produced by PosBytes. Bytes after the
+// encoded position are ignored. It returns nil if b is too short to hold a position.
 func NewPos(b []byte) []Identifier {
+	if len(b) == 0 || len(b) < int(b[0])*3+1 {
+		return nil
+	}
 	p := []Identifier{}
 	for i := 0; i < int(b[0]); i++ {
 		offset := i*3 + 1
@@ -0,0 +1,167 @@
+package document
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// errTruncated is returned when decoding an operation or a snapshot that was cut short.
+var errTruncated = errors.New("document: truncated data")
+
+// MarshalBinary encodes the operation, for instance to log it. Positions longer than 255
+// identifiers cannot be encoded.
+func (op Op) MarshalBinary() ([]byte, error) {
+	return op.marshal(appendPos)
+}
+
+// MarshalVarint encodes the operation like MarshalBinary, with its positions encoded by
+// PosVarint.
+func (op Op) MarshalVarint() ([]byte, error) {
+	return op.marshal(appendPosVarint)
+}
+
+// marshal encodes the operation, with its positions appended by pos.
+func (op Op) marshal(pos func(b []byte, p []Identifier) []byte) ([]byte, error) {
+	for _, p := range append([][]Identifier{op.Pos}, op.Positions...) {
+		if len(p) > 255 {
+			return nil, errors.New("document: position too long to encode")
+		}
+	}
+	b := []byte{byte(op.Kind), op.ID.Site}
+	b = binary.AppendUvarint(b, op.ID.Clock)
+	b = binary.AppendUvarint(b, uint64(op.Epoch))
+	b = pos(b, op.Pos)
+	b = binary.AppendUvarint(b, uint64(len(op.Atom)))
+	b = append(b, op.Atom...)
+	b = append(b, op.Target.Site)
+	b = binary.AppendUvarint(b, op.Target.Clock)
+	b = binary.AppendUvarint(b, uint64(len(op.Positions)))
+	for _, p := range op.Positions {
+		b = pos(b, p)
+	}
+	b = binary.AppendVarint(b, op.Time)
+	if op.GroupSize > 0 {
+		b = append(b, op.Group.Site)
+		b = binary.AppendUvarint(b, op.Group.Clock)
+		b = binary.AppendUvarint(b, uint64(op.GroupSize))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes an operation encoded by MarshalBinary.
+func (op *Op) UnmarshalBinary(b []byte) error {
+	return op.unmarshal(reader{b: b})
+}
+
+// UnmarshalVarint decodes an operation encoded by MarshalVarint.
+func (op *Op) UnmarshalVarint(b []byte) error {
+	return op.unmarshal(reader{b: b, varintPos: true})
+}
+
+// unmarshal decodes an operation read by r.
+func (op *Op) unmarshal(r reader) error {
+	*op = Op{}
+	op.Kind = OpKind(r.byte())
+	op.ID.Site = r.byte()
+	op.ID.Clock = r.uvarint()
+	op.Epoch = uint32(r.uvarint())
+	op.Pos = r.pos()
+	op.Atom = string(r.bytes(r.uvarint()))
+	op.Target.Site = r.byte()
+	op.Target.Clock = r.uvarint()
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		op.Positions = append(op.Positions, r.pos())
+	}
+	if r.err == nil && len(r.b) > 0 { // operations encoded before they had a time have none
+		op.Time = r.varint()
+	}
+	if r.err == nil && len(r.b) > 0 { // nor a group, and most operations are not grouped
+		op.Group.Site = r.byte()
+		op.Group.Clock = r.uvarint()
+		op.GroupSize = uint32(r.uvarint())
+	}
+	return r.err
+}
+
+// appendPos appends the position as encoded by PosBytes. An empty position is kept
+// empty.
+func appendPos(b []byte, p []Identifier) []byte {
+	if len(p) == 0 {
+		return append(b, 0)
+	}
+	return append(b, PosBytes(p)...)
+}
+
+// appendPosVarint appends the position as encoded by PosVarint.
+func appendPosVarint(b []byte, p []Identifier) []byte {
+	return append(b, PosVarint(p)...)
+}
+
+// reader decodes the fields of an operation or a snapshot, remembering the first error.
+type reader struct {
+	b         []byte
+	err       error
+	varintPos bool // positions are encoded by PosVarint, not PosBytes
+}
+
+func (r *reader) bytes(n uint64) []byte {
+	if r.err != nil || n > uint64(len(r.b)) {
+		r.err = errTruncated
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if v := r.bytes(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) pos() []Identifier {
+	if r.varintPos && r.err == nil {
+		p, n := NewPosVarint(r.b)
+		if n == 0 {
+			r.err = errTruncated
+			return nil
+		}
+		r.b = r.b[n:]
+		return p
+	}
+	n := uint64(r.byte())
+	b := r.bytes(n * 3)
+	if b == nil || n == 0 {
+		return nil
+	}
+	return NewPos(append([]byte{byte(n)}, b...))
+}
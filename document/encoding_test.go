@@ -0,0 +1,50 @@
+package document
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestOpRoundTrip(t *testing.T) {
+	ops := []Op{
+		{Kind: InsertOp, ID: OpID{3, 1}, Pos: []Identifier{{12, 3}, {65535, 1}}, Atom: "é", Time: 1e18},
+		{Kind: DeleteOp, ID: OpID{1, 300}, Epoch: 2, Pos: []Identifier{{7, 1}}, Target: OpID{3, 1}},
+		{Kind: RebalanceOp, ID: OpID{1, 1 << 40}, Positions: [][]Identifier{{{1, 1}}, {{1, 1}, {9, 2}}}},
+		{Kind: InsertOp, ID: OpID{2, 5}, Pos: []Identifier{{3, 2}}, Atom: "x", Group: OpID{2, 4}, GroupSize: 2},
+	}
+	for _, op := range ops {
+		b, err := op.MarshalBinary()
+		assert.NilError(t, err)
+		var got Op
+		assert.NilError(t, got.UnmarshalBinary(b))
+		assert.DeepEqual(t, got, op)
+		v, err := op.MarshalVarint()
+		assert.NilError(t, err)
+		assert.NilError(t, got.UnmarshalVarint(v))
+		assert.DeepEqual(t, got, op)
+
+		// every truncation is reported, but the time and the group may be missing
+		optional := len(binary.AppendVarint(nil, op.Time))
+		if op.GroupSize > 0 {
+			optional += 1 + len(binary.AppendUvarint(nil, op.Group.Clock)) + len(binary.AppendUvarint(nil, uint64(op.GroupSize)))
+		}
+		for i := range b[:len(b)-optional] {
+			assert.Assert(t, got.UnmarshalBinary(b[:i]) != nil, "%d bytes of %v", i, op)
+		}
+		for i := range v[:len(v)-optional] {
+			assert.Assert(t, got.UnmarshalVarint(v[:i]) != nil, "%d varint bytes of %v", i, op)
+		}
+	}
+
+	var old Op // encoded before operations had a time
+	b, _ := ops[1].MarshalBinary()
+	assert.NilError(t, old.UnmarshalBinary(b[:len(b)-1]))
+	assert.DeepEqual(t, old, ops[1])
+
+	_, err := Op{Pos: make([]Identifier, 256)}.MarshalBinary()
+	assert.Assert(t, err != nil)
+	_, err = Op{Pos: make([]Identifier, 256)}.MarshalVarint()
+	assert.Assert(t, err != nil)
+}
@@ -0,0 +1,203 @@
+package document
+
+import (
+	"bytes"
+	"testing"
+)
+
+// seedPositions are the positions used by the GeneratePos tests, fed to the fuzzers as
+// their seed corpus.
+var seedPositions = [][2][]Identifier{
+	{{{13627, 1}, {65036, 1}, {24224, 1}}, {{13628, 1}}},
+	{{{65534, 68}, {48896, 57}, {65534, 68}}, {{65534, 68}, {48896, 68}}},
+	{{{56, 68}, {31603, 68}}, {{56, 68}, {31603, 68}, {1, 68}}},
+	{{{56, 68}, {31603, 68}, {15, 68}}, {{56, 68}, {31603, 68}, {278, 68}}},
+	{{{56, 68}, {31603, 68}, {15, 68}}, {{56, 68}, {31603, 68}, {16, 68}}},
+	{{{56, 68}, {31603, 68}, {65534, 68}}, {{56, 68}, {31603, 68}, {65535, 68}}},
+	{{{6623, 68}, {65534, 68}}, {{6624, 68}, {62098, 68}}},
+	{{{6623, 68}, {65534, 68}}, {{6623, 68}, {65535, 68}}},
+	{{{0, 68}}, {{0, 68}, {0, 68}, {2, 68}}},
+	{Start, End},
+}
+
+// onlyZeros reports whether every identifier of p is {0, 0}.
+func onlyZeros(p []Identifier) bool {
+	for _, e := range p {
+		if e.Ident != 0 || e.Site != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzPosRoundTrip(f *testing.F) {
+	for _, s := range seedPositions {
+		f.Add(PosBytes(s[0]))
+		f.Add(PosBytes(s[1]))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p := NewPos(b)
+		if p == nil {
+			return
+		}
+		enc := PosBytes(p)
+		if !bytes.Equal(enc, b[:len(enc)]) {
+			t.Fatalf("PosBytes(NewPos(%x)) = %x", b, enc)
+		}
+		if ComparePos(NewPos(enc), p) != 0 {
+			t.Fatalf("NewPos(PosBytes(%v)) = %v", p, NewPos(enc))
+		}
+	})
+}
+
+func FuzzNewPos(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{2, 0, 1})
+	for _, s := range seedPositions {
+		f.Add(PosBytes(s[0]))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p := NewPos(b) // must not panic
+		if p != nil && len(b) < len(p)*3+1 {
+			t.Fatalf("NewPos(%x) decoded %d identifiers from %d bytes", b, len(p), len(b))
+		}
+	})
+}
+
+func FuzzNewPosVarint(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{1, 0x80, 0x80, 0x04, 1})
+	for _, s := range seedPositions {
+		f.Add(PosVarint(s[0]))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, n := NewPosVarint(b) // must not panic
+		if n == 0 {
+			return
+		}
+		enc := PosVarint(p)
+		if q, m := NewPosVarint(enc); m != len(enc) || ComparePos(q, p) != 0 {
+			t.Fatalf("NewPosVarint(PosVarint(%v)) = %v", p, q)
+		}
+	})
+}
+
+func FuzzComparePos(f *testing.F) {
+	for _, s := range seedPositions {
+		f.Add(PosBytes(s[0]), PosBytes(s[1]), PosBytes(s[0]))
+	}
+	f.Fuzz(func(t *testing.T, ab, bb, cb []byte) {
+		a, b, c := NewPos(ab), NewPos(bb), NewPos(cb)
+		if a == nil || b == nil || c == nil {
+			return
+		}
+		if ComparePos(a, a) != 0 {
+			t.Fatalf("%v is not equal to itself", a)
+		}
+		if ComparePos(a, b) != -ComparePos(b, a) {
+			t.Fatalf("ComparePos(%v, %v) is not antisymmetric", a, b)
+		}
+		if ComparePos(a, b) == 0 && !bytes.Equal(PosBytes(a), PosBytes(b)) {
+			t.Fatalf("%v and %v compare equal", a, b)
+		}
+		if ComparePos(a, b) <= 0 && ComparePos(b, c) <= 0 && ComparePos(a, c) > 0 {
+			t.Fatalf("ComparePos is not transitive on %v <= %v <= %v", a, b, c)
+		}
+	})
+}
+
+func FuzzGeneratePos(f *testing.F) {
+	for _, s := range seedPositions {
+		f.Add(PosBytes(s[0]), PosBytes(s[1]), uint8(68))
+		f.Add(PosBytes(s[0]), PosBytes(s[1]), uint8(0))
+	}
+	f.Fuzz(func(t *testing.T, lb, rb []byte, site uint8) {
+		lp, rp := NewPos(lb), NewPos(rb)
+		if len(lp) == 0 || len(rp) == 0 { // empty positions are undefined
+			return
+		}
+		p, ok := GeneratePos(lp, rp, site)
+		if ComparePos(lp, rp) != -1 {
+			if ok {
+				t.Fatalf("GeneratePos(%v, %v) = %v, want failure", lp, rp, p)
+			}
+			return
+		}
+		if !ok {
+			// nothing fits between lp and lp followed by {0, 0}s
+			if len(rp) <= len(lp) || ComparePos(lp, rp[:len(lp)]) != 0 || !onlyZeros(rp[len(lp):]) {
+				t.Fatalf("GeneratePos(%v, %v) failed", lp, rp)
+			}
+			return
+		}
+		if ComparePos(lp, p) != -1 || ComparePos(p, rp) != -1 {
+			t.Fatalf("GeneratePos(%v, %v) = %v, not in between", lp, rp, p)
+		}
+		if p[len(p)-1].Site != site {
+			t.Fatalf("GeneratePos(%v, %v, %d) = %v, last identifier not owned by site", lp, rp, site, p)
+		}
+	})
+}
+
+func FuzzOpUnmarshal(f *testing.F) {
+	for _, s := range seedPositions {
+		b, _ := Op{Kind: InsertOp, ID: OpID{1, 2}, Pos: s[0], Atom: "a"}.MarshalBinary()
+		f.Add(b)
+		b, _ = Op{Kind: RebalanceOp, ID: OpID{1, 3}, Positions: s[:]}.MarshalBinary()
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var op Op
+		if op.UnmarshalBinary(b) != nil { // must not panic
+			return
+		}
+		enc, err := op.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again Op
+		if err := again.UnmarshalBinary(enc); err != nil {
+			t.Fatalf("re-encoded %v does not decode: %v", op, err)
+		}
+	})
+}
+
+func FuzzOpsUnmarshal(f *testing.F) {
+	d := NewDocument(nil, 1)
+	p := Start
+	for _, c := range "typing" {
+		p, _ = d.InsertRight(p, string(c))
+	}
+	d.DeleteLeft(p)
+	b, _ := MarshalOps(d.TakeOps())
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		ops, err := UnmarshalOps(b) // must not panic
+		if err != nil {
+			return
+		}
+		enc, err := MarshalOps(ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := UnmarshalOps(enc); err != nil {
+			t.Fatalf("re-encoded %v does not decode: %v", ops, err)
+		}
+	})
+}
+
+func FuzzSnapshotUnmarshal(f *testing.F) {
+	d := NewDocument([]string{"a", "b"}, 1)
+	d.InsertRight(Start, "x")
+	d.DeleteLeft(End)
+	b, _ := d.MarshalBinary()
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var d Document
+		if d.UnmarshalBinary(b) != nil { // must not panic
+			return
+		}
+		d.InsertRight(Start, "y")
+		d.Content()
+	})
+}
@@ -0,0 +1,135 @@
+package document
+
+import "hash/fnv"
+
+// gcEvery is the number of operations between two automatic garbage collections.
+const gcEvery = 256
+
+// GCStats describes the tombstones of a Document and what garbage collection did with
+// them.
+type GCStats struct {
+	Tombstones int // tombstones currently kept
+	Pending    int // tombstones whose insert has not been seen yet
+	Retired    int // collected positions of this site, remembered so they are not reused
+	Collected  int // tombstones collected since the Document was created
+	Runs       int // number of collections
+}
+
+// ObserveVersion records the version vector reported by another site. Version vectors only
+// grow, so an older report never undoes a newer one.
+func (d *Document) ObserveVersion(site uint8, vv VersionVector) {
+	if site == d.clientID {
+		return
+	}
+	d.knowSite(site)
+	if _, bounded := d.bounds[site]; !bounded && vv.Includes(d.rebalance) {
+		// site reports having applied the last rebalance, so it issued everything of
+		// the previous epoch by now
+		d.bounds[site] = vv[site]
+	}
+	known := d.peers[site]
+	for s, clock := range vv {
+		if clock > known[s] {
+			known[s] = clock
+		}
+	}
+}
+
+// ForgetSite removes a site that left the session for good. Until then, the last version
+// vector it reported holds back the collection of every tombstone it has not seen, so a
+// peer that is only offline for a while never misses a delete.
+func (d *Document) ForgetSite(site uint8) {
+	delete(d.peers, site)
+}
+
+// knowSite adds the site to the known sites. Its version vector is empty until it
+// reports one, which keeps every tombstone.
+func (d *Document) knowSite(site uint8) {
+	if d.peers == nil {
+		d.peers = make(map[uint8]VersionVector)
+	}
+	if _, known := d.peers[site]; !known {
+		d.peers[site] = make(VersionVector)
+	}
+}
+
+// stable reports whether every known site has applied the operation.
+func (d *Document) stable(id OpID) bool {
+	if !d.version.Includes(id) {
+		return false
+	}
+	for _, vv := range d.peers {
+		if !vv.Includes(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// CollectGarbage drops the tombstones that are no longer needed and returns how many
+// were dropped. A tombstone is needed until every known site has applied its delete,
+// since a site that has not may still send the deleted pair around, and until the
+// insert it swallows has been seen here, since after that copies of the insert are
+// recognized by their OpID. Tombstones of deletes that did not come through an Op are
+// kept forever. Operations every known site has applied are dropped from the sync log.
+func (d *Document) CollectGarbage() int {
+	n := 0
+	for k, t := range d.tombstones {
+		if !t.seen || !d.stable(t.id) {
+			continue
+		}
+		if t.pos[len(t.pos)-1].Site == d.clientID {
+			if d.retired == nil {
+				d.retired = make(map[uint64]bool)
+			}
+			d.retired[posHash(t.pos)] = true
+		}
+		delete(d.tombstones, k)
+		n++
+	}
+	d.trimLog()
+	d.gc.Collected += n
+	d.gc.Runs++
+	d.sinceGC = 0
+	return n
+}
+
+// GCStats returns statistics about tombstones and their collection.
+func (d *Document) GCStats() GCStats {
+	s := d.gc
+	s.Tombstones = len(d.tombstones)
+	s.Retired = len(d.retired)
+	s.Pending = 0
+	for _, t := range d.tombstones {
+		if !t.seen {
+			s.Pending++
+		}
+	}
+	return s
+}
+
+// tick counts an applied operation and collects garbage every gcEvery operations.
+func (d *Document) tick() {
+	d.sinceGC++
+	if d.sinceGC >= gcEvery {
+		d.CollectGarbage()
+	}
+}
+
+// wasRetired reports whether this site generated the position and collected it. After a
+// rebalance, positions translated from the previous epoch end with their old position,
+// so that one is checked as well.
+func (d *Document) wasRetired(p []Identifier) bool {
+	if d.retired[posHash(p)] {
+		return true
+	}
+	return d.prev != nil && len(p) > d.prev.width && d.retired[posHash(p[d.prev.width:])]
+}
+
+// posHash hashes a position. Collected positions are only remembered by hash: a
+// collision merely makes GeneratePos pick another position.
+func posHash(p []Identifier) uint64 {
+	h := fnv.New64a()
+	h.Write(PosBytes(p))
+	return h.Sum64()
+}
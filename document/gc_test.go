@@ -0,0 +1,63 @@
+package document
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestCollectGarbageWaitsForEverySite(t *testing.T) {
+	c := strings.Split("abc", "")
+	doc1 := NewDocument(c, 1)
+	doc2 := &Document{clientID: 2}
+	doc3 := &Document{clientID: 3}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+		doc3.insert(e.pos, e.atom)
+	}
+	doc1.ObserveVersion(2, nil)
+	doc1.ObserveVersion(3, nil)
+
+	doc1.DeleteRight(Start) // delete a
+	op := doc1.TakeOps()[0]
+	assert.Equal(t, doc2.Apply(op), true)
+	assert.Equal(t, doc2.Apply(op), false) // duplicates are recognized
+
+	// doc3 is offline, its tombstone must survive
+	doc1.ObserveVersion(2, doc2.Version())
+	assert.Equal(t, doc1.CollectGarbage(), 0)
+	assert.Equal(t, doc1.GCStats().Tombstones, 1)
+
+	doc3.Apply(op)
+	doc1.ObserveVersion(3, doc3.Version())
+	assert.Equal(t, doc1.CollectGarbage(), 1)
+	s := doc1.GCStats()
+	assert.Equal(t, s.Tombstones, 0)
+	assert.Equal(t, s.Collected, 1)
+	assert.Equal(t, doc1.Content(), "bc")
+}
+
+func TestCollectGarbageKeepsPendingDeletes(t *testing.T) {
+	doc1 := NewDocument(nil, 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+
+	doc1.InsertRight(Start, "x")
+	doc1.DeleteRight(Start)
+	ops := doc1.TakeOps()
+
+	// the delete overtakes the insert
+	doc2.Apply(ops[1])
+	doc2.ObserveVersion(1, doc1.Version())
+	assert.Equal(t, doc2.GCStats().Pending, 1)
+	assert.Equal(t, doc2.CollectGarbage(), 0)
+
+	doc2.Apply(ops[0])
+	assert.Equal(t, doc2.Content(), "")
+	assert.Equal(t, doc2.CollectGarbage(), 1)
+	assert.Equal(t, doc2.Apply(ops[0]), false) // a late copy of the insert stays out
+	assert.Equal(t, doc2.Content(), "")
+}
@@ -0,0 +1,85 @@
+package document
+
+import "sort"
+
+// Begin starts a group of local operations, such as the deletes and inserts of a
+// replace, that peers apply all at once. The operations are applied here as they are
+// made, but are only taken with TakeOps and reported to watchers once the group is
+// committed. Groups may be nested: the outermost one is the group.
+func (d *Document) Begin() {
+	d.txn++
+}
+
+// Commit ends the group started by the matching Begin.
+func (d *Document) Commit() {
+	if d.txn == 0 {
+		return
+	}
+	if d.txn--; d.txn > 0 || len(d.staged) == 0 {
+		return
+	}
+	ops := d.staged
+	d.staged = nil
+	if len(ops) > 1 {
+		for i := range ops {
+			ops[i].Group, ops[i].GroupSize = ops[0].ID, uint32(len(ops))
+		}
+	}
+	for _, op := range ops {
+		d.outbox = append(d.outbox, op)
+		d.remember(op)
+	}
+	d.changed(ops...)
+}
+
+// Watch registers f to be called with the operations of every change of the Document,
+// local or remote, once the change is applied. A group is a single change. The Document
+// must not be modified from f.
+func (d *Document) Watch(f func(ops []Op)) {
+	d.watchers = append(d.watchers, f)
+}
+
+// changed reports a change to the watchers.
+func (d *Document) changed(ops ...Op) {
+	if d.quiet {
+		return
+	}
+	for _, f := range d.watchers {
+		f(ops)
+	}
+}
+
+// applyGroup keeps an operation of a remote group until the group is complete, then
+// applies it all. The operations of a group follow each other at the site that made
+// them, so they are applied in the order of their clocks.
+func (d *Document) applyGroup(op Op) bool {
+	ops := d.partial[op.Group]
+	for _, o := range ops {
+		if o.ID == op.ID {
+			return false
+		}
+	}
+	ops = append(ops, op)
+	if len(ops) < int(op.GroupSize) {
+		if d.partial == nil {
+			d.partial = make(map[OpID][]Op)
+		}
+		d.partial[op.Group] = ops
+		return true
+	}
+	delete(d.partial, op.Group)
+	sort.Slice(ops, func(i, j int) bool { return ops[i].ID.Clock < ops[j].ID.Clock })
+
+	d.quiet = true
+	var applied []Op
+	for _, o := range ops {
+		if d.apply(o) {
+			applied = append(applied, o)
+		}
+	}
+	d.quiet = false
+	if len(applied) > 0 {
+		d.changed(applied...)
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package document
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// replace replaces the characters from index i to j, excluded, in one group
+func replace(doc *Document, i, j int, text string) {
+	doc.Begin()
+	defer doc.Commit()
+	doc.deleteMultiple(i, j)
+	p := doc.pairs[i-1].pos
+	for _, c := range text {
+		p, _ = doc.InsertRight(p, string(c))
+	}
+}
+
+func TestGroupIsOneChange(t *testing.T) {
+	doc1, doc2 := undoPeers("Entangle Text")
+	var local, remote [][]Op
+	doc1.Watch(func(ops []Op) { local = append(local, ops) })
+	doc2.Watch(func(ops []Op) { remote = append(remote, ops) })
+
+	doc1.Begin()
+	replace(doc1, 1, 9, "Tangled") // nested groups are one
+	assert.Equal(t, len(doc1.TakeOps()), 0)
+	assert.Equal(t, len(local), 0)
+	doc1.InsertLeft(End, "!")
+	doc1.Commit()
+	assert.Equal(t, doc1.Content(), "Tangled Text!")
+	assert.Equal(t, len(local), 1)
+	assert.Equal(t, len(local[0]), 16)
+
+	// a peer applies nothing until it has the whole group, in whatever order it comes
+	ops := doc1.TakeOps()
+	assert.DeepEqual(t, local[0], ops)
+	for i := len(ops) - 1; i > 0; i-- {
+		assert.Assert(t, doc2.Apply(ops[i]))
+		assert.Assert(t, !doc2.Apply(ops[i]))
+		assert.Equal(t, doc2.Content(), "Entangle Text")
+	}
+	assert.Assert(t, doc2.Apply(ops[0]))
+	assert.Equal(t, doc2.Content(), "Tangled Text!")
+	assert.Equal(t, len(remote), 1)
+	assert.DeepEqual(t, remote[0], ops)
+
+	// operations outside of groups are changes of their own
+	doc1.InsertLeft(End, "?")
+	exchange(doc1, doc2)
+	assert.Equal(t, len(local), 2)
+	assert.Equal(t, len(remote), 2)
+}
+
+func TestRevertGroup(t *testing.T) {
+	doc1, doc2 := undoPeers("Entangle Text")
+	replace(doc2, 1, 9, "Tangled")
+	exchange(doc1, doc2)
+	doc1.InsertLeft(End, "!")
+	group := doc1.History()[2].ID
+
+	// any operation of the group stands for it
+	assert.NilError(t, doc1.Revert(group))
+	assert.Equal(t, doc1.Content(), "Entangle Text!")
+	exchange(doc1, doc2)
+	assert.Equal(t, doc2.Content(), doc1.Content())
+}
@@ -0,0 +1,80 @@
+package document
+
+import "time"
+
+// History returns every operation applied to the Document, local or remote, in the
+// order it was applied. Every prefix of the history is a state the Document went
+// through.
+func (d *Document) History() []Op {
+	return append([]Op(nil), d.history...)
+}
+
+// SetHistory replaces the history with the operations of ops the Document has applied,
+// in their order, the first time each. A Document restored from a snapshot gets its
+// history back this way, since snapshots do not hold it.
+func (d *Document) SetHistory(ops []Op) {
+	d.history, d.indexed = nil, make(map[OpID]int)
+	for _, op := range ops {
+		if _, ok := d.indexed[op.ID]; !ok && d.applied(op.ID) {
+			d.indexed[op.ID] = len(d.history)
+			d.history = append(d.history, op)
+		}
+	}
+}
+
+// HistoryOp returns the operation with the given ID, if it was applied.
+func (d *Document) HistoryOp(id OpID) (Op, bool) {
+	i, ok := d.indexed[id]
+	if !ok {
+		return Op{}, false
+	}
+	return d.history[i], true
+}
+
+// At returns the Document as it was with only the operations of vv applied. The past
+// Document is read-only: its inserts, deletes and Apply do nothing.
+func (d *Document) At(vv VersionVector) *Document {
+	return d.replay(func(i int, op Op) bool { return vv.Includes(op.ID) })
+}
+
+// AtTime returns the Document as it was with only the operations issued at or before t
+// applied, according to the clocks of the sites that issued them. See At.
+func (d *Document) AtTime(t time.Time) *Document {
+	return d.replay(func(i int, op Op) bool { return op.Time <= t.UnixNano() })
+}
+
+// AtIndex returns the Document as it was after the first n operations of its history.
+// See At.
+func (d *Document) AtIndex(n int) *Document {
+	return d.replay(func(i int, op Op) bool { return i < n })
+}
+
+// replay rebuilds a past Document from the content that did not come from operations
+// and the operations of the history that include accepts.
+func (d *Document) replay(include func(i int, op Op) bool) *Document {
+	past := &Document{clientID: d.clientID}
+	for _, e := range d.base {
+		past.insertPair(e)
+	}
+	for site := range d.peers {
+		past.knowSite(site) // keeps tombstones around, as they would have been
+	}
+	for i, op := range d.history {
+		if include(i, op) {
+			past.Apply(op)
+		}
+	}
+	past.frozen = true
+	return past
+}
+
+// remember records an operation that has just been applied in the history and in the
+// log used for delta sync.
+func (d *Document) remember(op Op) {
+	if d.indexed == nil {
+		d.indexed = make(map[OpID]int)
+	}
+	d.indexed[op.ID] = len(d.history)
+	d.history = append(d.history, op)
+	d.log = append(d.log, op)
+}
@@ -0,0 +1,105 @@
+package document
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestAtReconstructsPastStates(t *testing.T) {
+	doc1 := NewDocument(strings.Split("Entangle", ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	doc1.ObserveVersion(2, nil)
+	doc2.ObserveVersion(1, nil)
+
+	var contents []string
+	var versions []VersionVector
+	checkpoint := func() {
+		contents = append(contents, doc1.Content())
+		versions = append(versions, doc1.Version())
+	}
+	exchange := func() {
+		for _, op := range doc1.TakeOps() {
+			doc2.Apply(op)
+		}
+		for _, op := range doc2.TakeOps() {
+			doc1.Apply(op)
+		}
+	}
+
+	checkpoint()
+	p, _ := doc1.InsertLeft(End, " ")
+	for _, c := range "Text" {
+		p, _ = doc1.InsertRight(p, string(c))
+	}
+	exchange()
+	checkpoint()
+	doc2.DeleteRight(Start)
+	doc2.InsertRight(Start, "e")
+	exchange()
+	checkpoint()
+	doc1.Rebalance()
+	doc2.InsertLeft(End, "!")
+	exchange()
+	checkpoint()
+	assert.Equal(t, doc1.Content(), "entangle Text!")
+
+	for i, vv := range versions {
+		assert.Equal(t, doc1.At(vv).Content(), contents[i])
+	}
+	history := doc1.History()
+	assert.Equal(t, len(history), 9)
+	assert.Equal(t, doc1.AtIndex(0).Content(), "Entangle")
+	assert.Equal(t, doc1.AtIndex(1).Content(), "Entangle ")
+	assert.Equal(t, doc1.AtIndex(len(history)).Content(), doc1.Content())
+
+	op, ok := doc1.HistoryOp(history[5].ID)
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, op, history[5])
+
+	// snapshots leave the history out, whoever keeps the operations gives it back
+	b, err := doc1.MarshalBinary()
+	assert.NilError(t, err)
+	var restored Document
+	assert.NilError(t, restored.UnmarshalBinary(b))
+	assert.Equal(t, len(restored.History()), 0)
+	unknown := Op{Kind: InsertOp, ID: OpID{Site: 9, Clock: 1}, Pos: []Identifier{{Ident: 1, Site: 9}}, Atom: "?"}
+	restored.SetHistory(append(append(history[:2:2], unknown), history...))
+	assert.DeepEqual(t, restored.History(), history)
+	assert.Equal(t, restored.At(versions[2]).Content(), contents[2])
+}
+
+func TestAtTime(t *testing.T) {
+	doc1 := NewDocument(strings.Split("abc", ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p, _ := doc1.InsertRight(Start, "x")
+	for i, op := range doc1.TakeOps() {
+		op.Time = t0.Add(time.Duration(i) * time.Minute).UnixNano()
+		doc2.Apply(op)
+	}
+	doc1.DeleteRight(p)
+	for _, op := range doc1.TakeOps() {
+		op.Time = t0.Add(time.Hour).UnixNano()
+		doc2.Apply(op)
+	}
+
+	assert.Equal(t, doc2.AtTime(t0.Add(-time.Second)).Content(), "abc")
+	assert.Equal(t, doc2.AtTime(t0).Content(), "xabc")
+	assert.Equal(t, doc2.AtTime(t0.Add(time.Hour)).Content(), "xbc")
+
+	// the past is read-only
+	past := doc2.AtTime(t0)
+	_, ok := past.InsertRight(Start, "y")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, past.DeleteLeft(End), false)
+	assert.Equal(t, past.Content(), "xabc")
+}
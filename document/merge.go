@@ -0,0 +1,174 @@
+package document
+
+// Merge joins two replicas of the same Document into a new one, leaving both untouched.
+// The result holds the union of their inserts minus the union of their deletes, and
+// knows every operation either of them applied, so merging is commutative, associative
+// and idempotent. This allows replicas to be reconciled from saved copies instead of
+// operations, for instance when working offline.
+//
+// A pair present in one replica only is kept unless the other one applied its insert:
+// the other replica then deleted it and may have collected the tombstone since. Initial
+// content, which does not come from an insert, is shared by every replica, so it is
+// only kept if both still have it.
+//
+// Replicas one rebalance apart are merged in the later epoch. Replicas further apart
+// cannot be merged and false is returned. Site-local state, such as the site ID and the
+// operations not taken for broadcast yet, comes from a.
+func Merge(a, b *Document) (*Document, bool) {
+	later, earlier := a, b
+	if b.epoch > a.epoch {
+		later, earlier = b, a
+	}
+	if later.epoch-earlier.epoch > 1 {
+		return nil, false
+	}
+	translate := func(p []Identifier) []Identifier { return p }
+	if later.epoch != earlier.epoch {
+		translate = later.prev.translate
+	}
+	at := func(d *Document, p []Identifier) []Identifier {
+		if d == later || ComparePos(p, Start) == 0 || ComparePos(p, End) == 0 {
+			return p
+		}
+		return translate(p)
+	}
+
+	m := &Document{
+		clientID:  a.clientID,
+		clock:     a.clock,
+		gc:        a.gc,
+		epoch:     later.epoch,
+		prev:      later.prev,
+		rebalance: later.rebalance,
+		bounds:    later.bounds.Copy(),
+		version:   a.version.Copy(),
+	}
+	joinVersion(m.version, b.version)
+	for _, d := range []*Document{a, b} {
+		for id := range d.ahead {
+			if !m.version.Includes(id) {
+				m.observe(id)
+			}
+		}
+		for site, vv := range d.peers {
+			if site != m.clientID {
+				m.knowSite(site)
+				joinVersion(m.peers[site], vv)
+			}
+		}
+		for h := range d.retired {
+			if m.retired == nil {
+				m.retired = make(map[uint64]bool)
+			}
+			m.retired[h] = true
+		}
+	}
+	if b.clientID != m.clientID {
+		m.ObserveVersion(b.clientID, b.version)
+	}
+	if m.version[m.clientID] > m.clock {
+		m.clock = m.version[m.clientID]
+	}
+
+	m.tombstones = make(map[string]tombstone, len(a.tombstones)+len(b.tombstones))
+	for _, d := range []*Document{a, b} {
+		for _, t := range d.tombstones {
+			t.pos = at(d, t.pos)
+			k := string(PosBytes(t.pos))
+			if u, dead := m.tombstones[k]; dead {
+				t.seen = t.seen || u.seen
+				if lessID(u.id, t.id) {
+					t.id = u.id
+				}
+			}
+			m.tombstones[k] = t
+		}
+	}
+
+	// both pair lists are sorted, and translation keeps the order
+	m.pairs = make([]pair, 0, len(a.pairs)+len(b.pairs))
+	i, j := 0, 0
+	for i < len(a.pairs) || j < len(b.pairs) {
+		var e pair
+		var c int8
+		switch {
+		case i == len(a.pairs):
+			c = 1
+		case j == len(b.pairs):
+			c = -1
+		default:
+			c = ComparePos(at(a, a.pairs[i].pos), at(b, b.pairs[j].pos))
+		}
+		switch {
+		case c < 0:
+			e, i = a.pairs[i], i+1
+			e.pos = at(a, e.pos)
+			if e.id.Clock == 0 || b.applied(e.id) {
+				continue
+			}
+		case c > 0:
+			e, j = b.pairs[j], j+1
+			e.pos = at(b, e.pos)
+			if e.id.Clock == 0 || a.applied(e.id) {
+				continue
+			}
+		default:
+			e = a.pairs[i]
+			e.pos = at(a, e.pos)
+			if lessID(e.id, b.pairs[j].id) {
+				e.id = b.pairs[j].id
+			}
+			i, j = i+1, j+1
+		}
+		k := string(PosBytes(e.pos))
+		if t, dead := m.tombstones[k]; dead {
+			t.seen = true
+			m.tombstones[k] = t
+			continue
+		}
+		m.pairs = append(m.pairs, e)
+		m.added(e)
+	}
+
+	m.log = append(m.log, a.log...)
+	for _, op := range b.log {
+		if !a.applied(op.ID) {
+			m.log = append(m.log, op)
+		}
+	}
+	m.history = append(m.history, a.history...)
+	for _, op := range b.history {
+		if !a.applied(op.ID) {
+			m.history = append(m.history, op)
+		}
+	}
+	m.indexed = make(map[OpID]int, len(m.history))
+	for i, op := range m.history {
+		m.indexed[op.ID] = i
+	}
+	m.base = append(m.base, a.base...)
+	m.floor = a.floor.Copy()
+	joinVersion(m.floor, b.floor)
+	for _, d := range []*Document{a, b} {
+		for _, op := range d.deferred {
+			m.Apply(op)
+		}
+	}
+	m.outbox = append(m.outbox, a.outbox...)
+	m.maxDepth = a.maxDepth
+	return m, true
+}
+
+// joinVersion raises every clock of vv to the one in other.
+func joinVersion(vv, other VersionVector) {
+	for site, clock := range other {
+		if clock > vv[site] {
+			vv[site] = clock
+		}
+	}
+}
+
+// lessID orders operation IDs by site, then clock.
+func lessID(x, y OpID) bool {
+	return x.Site < y.Site || x.Site == y.Site && x.Clock < y.Clock
+}
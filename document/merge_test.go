@@ -0,0 +1,136 @@
+package document
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// diverge runs the workload of cfg without draining the network, leaving the replicas
+// with different, partially delivered states.
+func diverge(cfg clusterConfig, seed int64) *cluster {
+	c := newCluster(cfg, seed)
+	for step := 0; step < cfg.Steps; step++ {
+		c.local(c.rng.Intn(len(c.replicas)))
+		if c.rng.Intn(100) < cfg.GCPct {
+			c.gossip(c.rng.Intn(len(c.replicas)), c.rng.Intn(len(c.replicas)))
+		}
+		if c.rng.Intn(100) < cfg.DelayPct {
+			continue
+		}
+		c.deliver(c.rng.Intn(len(c.replicas)))
+	}
+	return c
+}
+
+// stateDiff describes the first difference in replicated state between x and y, or
+// returns "" if there is none. Site-local state is not compared.
+func stateDiff(x, y *Document) string {
+	if len(x.pairs) != len(y.pairs) {
+		return fmt.Sprintf("%d pairs != %d pairs", len(x.pairs), len(y.pairs))
+	}
+	for i, e := range x.pairs {
+		if ComparePos(e.pos, y.pairs[i].pos) != 0 || e.atom != y.pairs[i].atom || e.id != y.pairs[i].id {
+			return fmt.Sprintf("pair %d differs", i)
+		}
+	}
+	if len(x.tombstones) != len(y.tombstones) {
+		return fmt.Sprintf("%d tombstones != %d tombstones", len(x.tombstones), len(y.tombstones))
+	}
+	for k, t := range x.tombstones {
+		if u, dead := y.tombstones[k]; !dead || t.id != u.id || t.seen != u.seen {
+			return "tombstones differ"
+		}
+	}
+	for _, vv := range []VersionVector{x.version, y.version} {
+		for site := range vv {
+			if x.version[site] != y.version[site] {
+				return fmt.Sprintf("versions differ for site %d", site)
+			}
+		}
+	}
+	if len(x.ahead) != len(y.ahead) {
+		return "ahead operations differ"
+	}
+	for id := range x.ahead {
+		if !y.ahead[id] {
+			return "ahead operations differ"
+		}
+	}
+	if x.epoch != y.epoch {
+		return fmt.Sprintf("epoch %d != epoch %d", x.epoch, y.epoch)
+	}
+	return ""
+}
+
+func merge(t *testing.T, seed int64, a, b *Document) *Document {
+	m, ok := Merge(a, b)
+	assert.Assert(t, ok, "seed %d", seed)
+	return m
+}
+
+func TestMergeSemilattice(t *testing.T) {
+	cfg := clusterConfig{
+		Replicas:  3,
+		Steps:     300,
+		Content:   "Entangle Text",
+		InsertPct: 60,
+		DupPct:    20,
+		DelayPct:  60,
+		Atoms:     "abcdefghijklmnopqrstuvwxyz ",
+		GCPct:     20,
+	}
+	base := rand.Int63()
+	for seed := base; seed < base+30; seed++ {
+		c := diverge(cfg, seed)
+		a, b, d := c.replicas[0], c.replicas[1], c.replicas[2]
+
+		if diff := stateDiff(merge(t, seed, a, a), a); diff != "" {
+			t.Errorf("seed %d: merge is not idempotent: %s", seed, diff)
+		}
+		if diff := stateDiff(merge(t, seed, a, b), merge(t, seed, b, a)); diff != "" {
+			t.Errorf("seed %d: merge is not commutative: %s", seed, diff)
+		}
+		left := merge(t, seed, merge(t, seed, a, b), d)
+		right := merge(t, seed, a, merge(t, seed, b, d))
+		if diff := stateDiff(left, right); diff != "" {
+			t.Errorf("seed %d: merge is not associative: %s", seed, diff)
+		}
+
+		// merging every replica gives what delivering every operation gives
+		c.drain()
+		if msg := c.diverged(); msg != "" {
+			t.Fatalf("seed %d did not converge: %s", seed, msg)
+		}
+		assert.Equal(t, left.Content(), c.replicas[0].Content(), "seed %d", seed)
+	}
+}
+
+func TestMergeAcrossRebalance(t *testing.T) {
+	doc1 := NewDocument(strings.Split("abc", ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	doc1.ObserveVersion(2, nil)
+	doc2.ObserveVersion(1, nil)
+
+	doc1.InsertRight(Start, "x")
+	doc1.Rebalance()
+	p, _ := doc2.InsertLeft(End, "y")
+	doc2.InsertLeft(p, "z")
+
+	m, ok := Merge(doc2, doc1)
+	assert.Assert(t, ok)
+	assert.Equal(t, m.Epoch(), uint32(1))
+	assert.Equal(t, m.Content(), "xabczy")
+
+	// the rebalanced replica gets the same result from operations
+	for _, op := range doc2.TakeOps() {
+		doc1.Apply(op)
+	}
+	assert.Equal(t, stateDiff(m, doc1), "")
+}
@@ -0,0 +1,202 @@
+package document
+
+import "hash/fnv"
+
+// The Merkle tree of a Document summarizes its pairs so that two replicas can find where
+// they differ without sending them. It is a complete binary tree over the first
+// identifier of positions: leaf i covers the positions whose first Ident is in
+// LeafRange(i). Nodes are numbered from 1 for the root, the children of node n being 2n
+// and 2n+1, and the leaves come last.
+//
+// The digest of a node is the XOR of the hashes of the pairs it covers, so inserting or
+// deleting a pair only updates the nodes on the path from its leaf to the root.
+const (
+	merkleDepth  = 8
+	MerkleLeaves = 1 << merkleDepth
+	MerkleRoot   = 1
+)
+
+// LeafRange returns the first Ident values covered by a leaf, both included.
+func LeafRange(leaf int) (lo, hi uint16) {
+	i := leaf - MerkleLeaves
+	return uint16(i << (16 - merkleDepth)), uint16((i+1)<<(16-merkleDepth) - 1)
+}
+
+// IsLeaf reports whether the node is a leaf of the Merkle tree.
+func IsLeaf(node int) bool {
+	return node >= MerkleLeaves
+}
+
+// Digest returns the digest of a node of the Merkle tree.
+func (d *Document) Digest(node int) uint64 {
+	if d.merkle == nil {
+		return 0
+	}
+	return d.merkle[node]
+}
+
+// Diff walks down the Merkle tree of the Document and the one behind remote, which
+// returns the digests of the requested nodes, and returns the leaves that differ. Only
+// the children of differing nodes are requested, so replicas that differ in a few
+// places exchange a few digests per level.
+func (d *Document) Diff(remote func(nodes []int) ([]uint64, error)) ([]int, error) {
+	nodes := []int{MerkleRoot}
+	var leaves []int
+	for len(nodes) > 0 {
+		digests, err := remote(nodes)
+		if err != nil {
+			return nil, err
+		}
+		var next []int
+		for i, n := range nodes {
+			if i < len(digests) && digests[i] == d.Digest(n) {
+				continue
+			}
+			if IsLeaf(n) {
+				leaves = append(leaves, n)
+			} else {
+				next = append(next, 2*n, 2*n+1)
+			}
+		}
+		nodes = next
+	}
+	return leaves, nil
+}
+
+// Entry is a pair as shipped between replicas to repair a range.
+type Entry struct {
+	Pos  []Identifier
+	Atom string
+	ID   OpID // the insert that created the pair
+}
+
+// Grave is a tombstone as shipped between replicas to repair a range.
+type Grave struct {
+	Pos  []Identifier
+	ID   OpID // the delete that created the tombstone
+	Seen bool
+}
+
+// Slice is the state of a Document restricted to some leaves of its Merkle tree, along
+// with what the Document has applied, which tells a missing pair deleted there apart
+// from one that was never inserted there.
+type Slice struct {
+	Epoch   uint32
+	Leaves  []int
+	Entries []Entry
+	Graves  []Grave
+	Version VersionVector
+	Ahead   []OpID
+}
+
+// Slice returns the state of the Document covered by the leaves.
+func (d *Document) Slice(leaves []int) Slice {
+	s := Slice{Epoch: d.epoch, Leaves: leaves, Version: d.Version()}
+	in := make(map[int]bool, len(leaves))
+	for _, l := range leaves {
+		in[l] = true
+	}
+	for _, e := range d.pairs {
+		if in[leafOf(e.pos)] {
+			s.Entries = append(s.Entries, Entry{Pos: e.pos, Atom: e.atom, ID: e.id})
+		}
+	}
+	for _, t := range d.tombstones {
+		if in[leafOf(t.pos)] {
+			s.Graves = append(s.Graves, Grave{Pos: t.pos, ID: t.id, Seen: t.seen})
+		}
+	}
+	for id := range d.ahead {
+		s.Ahead = append(s.Ahead, id)
+	}
+	return s
+}
+
+// Repair merges a slice of another replica into the Document, as Merge would, and
+// returns the number of pairs inserted or deleted. Slices of another epoch are ignored.
+//
+// The operations behind the repaired pairs are not marked as applied: they are still
+// expected, and are ignored when they arrive.
+func (d *Document) Repair(s Slice) int {
+	if s.Epoch != d.epoch {
+		return 0
+	}
+	applied := func(id OpID) bool {
+		if s.Version.Includes(id) {
+			return true
+		}
+		for _, a := range s.Ahead {
+			if a == id {
+				return true
+			}
+		}
+		return false
+	}
+	n := 0
+	for _, g := range s.Graves {
+		_, exists := d.Index(g.Pos)
+		d.bury(g.Pos, g.ID, g.Seen || exists)
+		if exists && d.deleteID(g.Pos, g.ID, OpID{}) {
+			n++
+		}
+	}
+	theirs := make(map[string]bool, len(s.Entries))
+	for _, e := range s.Entries {
+		theirs[string(PosBytes(e.Pos))] = true
+		if e.ID.Clock == 0 || d.applied(e.ID) {
+			continue
+		}
+		if d.insertPair(pair{pos: e.Pos, atom: e.Atom, id: e.ID}) {
+			n++
+		}
+	}
+	in := make(map[int]bool, len(s.Leaves))
+	for _, l := range s.Leaves {
+		in[l] = true
+	}
+	var gone [][]Identifier
+	for _, e := range d.pairs {
+		if in[leafOf(e.pos)] && !theirs[string(PosBytes(e.pos))] && e.id.Clock != 0 && applied(e.id) {
+			gone = append(gone, e.pos)
+		}
+	}
+	for _, p := range gone {
+		// deleted there and the tombstone collected, so every site applied the delete
+		i, _ := d.Index(p)
+		d.removed(d.pairs[i])
+		d.pairs = append(d.pairs[:i], d.pairs[i+1:]...)
+		n++
+	}
+	return n
+}
+
+// leafOf returns the leaf of the Merkle tree covering the position.
+func leafOf(p []Identifier) int {
+	return MerkleLeaves + int(p[0].Ident>>(16-merkleDepth))
+}
+
+// added updates the bookkeeping of the Document for a pair that was just inserted.
+func (d *Document) added(e pair) {
+	d.ids += len(e.pos)
+	d.touch(e)
+}
+
+// removed updates the bookkeeping of the Document for a pair that was just deleted.
+func (d *Document) removed(e pair) {
+	d.ids -= len(e.pos)
+	d.touch(e)
+}
+
+// touch flips the hash of the pair in the nodes covering it.
+func (d *Document) touch(e pair) {
+	if d.merkle == nil {
+		d.merkle = make([]uint64, 2*MerkleLeaves)
+	}
+	h := fnv.New64a()
+	h.Write(PosBytes(e.pos))
+	h.Write([]byte(e.atom))
+	sum := h.Sum64()
+	for n := leafOf(e.pos); n >= MerkleRoot; n >>= 1 {
+		d.merkle[n] ^= sum
+	}
+}
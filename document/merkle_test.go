@@ -0,0 +1,110 @@
+package document
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// remoteOf serves the digests of d as a peer would.
+func remoteOf(d *Document) func(nodes []int) ([]uint64, error) {
+	return func(nodes []int) ([]uint64, error) {
+		digests := make([]uint64, len(nodes))
+		for i, n := range nodes {
+			digests[i] = d.Digest(n)
+		}
+		return digests, nil
+	}
+}
+
+func TestLeafRange(t *testing.T) {
+	lo, hi := LeafRange(MerkleLeaves)
+	assert.Equal(t, lo, uint16(0))
+	last, _ := LeafRange(leafOf([]Identifier{{hi, 0}}))
+	assert.Equal(t, last, lo)
+	_, hi = LeafRange(2*MerkleLeaves - 1)
+	assert.Equal(t, hi, ^uint16(0))
+	assert.Equal(t, leafOf(End), 2*MerkleLeaves-1)
+}
+
+func TestDiffFindsLostOperations(t *testing.T) {
+	c := newCluster(clusterConfig{
+		Replicas:  2,
+		Steps:     300,
+		Content:   "Entangle Text",
+		InsertPct: 70,
+		Atoms:     "abcdefghijklmnopqrstuvwxyz ",
+	}, 1)
+	c.run()
+	doc1, doc2 := c.replicas[0], c.replicas[1]
+	assert.Equal(t, c.diverged(), "")
+	assert.Equal(t, doc1.Digest(MerkleRoot), doc2.Digest(MerkleRoot))
+	leaves, err := doc1.Diff(remoteOf(doc2))
+	assert.NilError(t, err)
+	assert.Equal(t, len(leaves), 0)
+
+	// doc2 never hears of an insert and a delete of doc1
+	p, _ := doc1.InsertRight(doc1.pairs[3].pos, "!")
+	doc1.DeleteLeft(End)
+	doc1.TakeOps()
+
+	leaves, err = doc1.Diff(remoteOf(doc2))
+	assert.NilError(t, err)
+	assert.Assert(t, len(leaves) >= 1 && len(leaves) <= 2)
+	assert.Assert(t, leaves[0] == leafOf(p) || leaves[len(leaves)-1] == leafOf(p))
+
+	assert.Equal(t, doc2.Repair(doc1.Slice(leaves)), 2)
+	assert.Equal(t, doc1.Content(), doc2.Content())
+	assert.Equal(t, doc1.Digest(MerkleRoot), doc2.Digest(MerkleRoot))
+
+	// the lost operations are ignored when they finally arrive
+	for _, op := range doc1.log {
+		doc2.Apply(op)
+	}
+	assert.Equal(t, doc1.Content(), doc2.Content())
+}
+
+func TestRepairAfterCollectedTombstone(t *testing.T) {
+	doc1 := NewDocument(strings.Split("abc", ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	doc1.ObserveVersion(2, nil)
+	doc2.ObserveVersion(1, nil)
+
+	p, _ := doc1.InsertRight(Start, "x")
+	for _, op := range doc1.TakeOps() {
+		doc2.Apply(op)
+	}
+	doc1.DeleteRight(Start)
+	doc1.TakeOps() // the delete is lost, and doc1 wrongly believes doc2 has it
+	doc1.ObserveVersion(2, doc1.Version())
+	doc1.CollectGarbage()
+	assert.Equal(t, len(doc1.tombstones), 0)
+
+	leaves, err := doc2.Diff(remoteOf(doc1))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, leaves, []int{leafOf(p)})
+	assert.Equal(t, doc2.Repair(doc1.Slice(leaves)), 1)
+	assert.Equal(t, doc2.Content(), "abc")
+
+	// a slice from another epoch is not applied
+	doc1.Rebalance()
+	assert.Equal(t, doc2.Repair(doc1.Slice(leaves)), 0)
+}
+
+func TestDigestSurvivesRebalance(t *testing.T) {
+	doc := NewDocument(strings.Split("Entangle Text", ""), 1)
+	p := doc.pairs[4].pos
+	for i := 0; i < 30; i++ {
+		p, _ = doc.InsertLeft(p, "x")
+	}
+	doc.Rebalance()
+	fresh := &Document{clientID: 2}
+	for _, e := range doc.pairs {
+		fresh.insert(e.pos, e.atom)
+	}
+	assert.Equal(t, doc.Digest(MerkleRoot), fresh.Digest(MerkleRoot))
+}
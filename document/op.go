@@ -0,0 +1,216 @@
+package document
+
+import "time"
+
+// OpKind tells what an Op does.
+type OpKind uint8
+
+const (
+	InsertOp OpKind = iota + 1
+	DeleteOp
+	RebalanceOp
+)
+
+// OpID identifies an operation by the site that issued it and the value of that site's
+// clock at the time. Every site numbers its operations 1, 2, 3... so the zero OpID
+// stands for "no operation".
+type OpID struct {
+	Site  uint8
+	Clock uint64
+}
+
+// Op is an insert, a delete or a rebalance, as sent to peers.
+type Op struct {
+	Kind      OpKind
+	ID        OpID
+	Epoch     uint32 // epoch the positions of the operation belong to
+	Pos       []Identifier
+	Atom      string         // inserted atom, empty for deletes
+	Target    OpID           // for deletes, the insert that created the deleted pair
+	Positions [][]Identifier // for rebalances, the positions being rewritten, in order
+	Time      int64          // wall time the operation was issued at, in Unix nanoseconds
+	Group     OpID           // first operation of the group the operation belongs to, see Begin
+	GroupSize uint32         // number of operations of the group, 0 if there is none
+}
+
+// VersionVector maps a site to the highest clock such that every operation of that site
+// up to it has been applied.
+type VersionVector map[uint8]uint64
+
+// Includes reports whether the operation is covered by the version vector.
+func (vv VersionVector) Includes(id OpID) bool {
+	return id.Clock != 0 && id.Clock <= vv[id.Site]
+}
+
+// Copy returns a copy of the version vector.
+func (vv VersionVector) Copy() VersionVector {
+	c := make(VersionVector, len(vv))
+	for site, clock := range vv {
+		c[site] = clock
+	}
+	return c
+}
+
+// Version returns the version vector of the operations applied to the Document.
+func (d *Document) Version() VersionVector {
+	return d.version.Copy()
+}
+
+// TakeOps returns the local operations performed since the last call, in the order they
+// were performed, so that they can be broadcast to peers.
+func (d *Document) TakeOps() []Op {
+	d.autoRebalance()
+	ops := d.outbox
+	d.outbox = nil
+	return ops
+}
+
+// Apply applies an operation received from a peer, returning whether it was new.
+// Operations may arrive in any order and any number of times.
+//
+// An operation of a later epoch waits for the rebalance that starts the epoch, and the
+// positions of an operation of the previous epoch are translated into the current one.
+// Operations older than that cannot be translated and are dropped, as are rebalances of
+// a past epoch; Dropped counts them.
+//
+// The operations of a group wait for each other and are applied together.
+func (d *Document) Apply(op Op) bool {
+	if d.frozen || d.applied(op.ID) {
+		return false
+	}
+	if op.GroupSize > 1 {
+		return d.applyGroup(op)
+	}
+	return d.apply(op)
+}
+
+// apply applies an operation received from a peer, ignoring groups.
+func (d *Document) apply(op Op) bool {
+	if d.applied(op.ID) {
+		return false
+	}
+	orig := op
+	if op.Epoch > d.epoch {
+		d.deferred = append(d.deferred, op)
+		return true
+	}
+	if op.Epoch < d.epoch {
+		if op.Epoch+1 != d.epoch || op.Kind == RebalanceOp {
+			d.dropped++
+			return false
+		}
+		op.Pos = d.prev.translate(op.Pos)
+	}
+	switch op.Kind {
+	case InsertOp:
+		d.insertPair(pair{pos: op.Pos, atom: op.Atom, id: op.ID})
+	case DeleteOp:
+		d.deleteID(op.Pos, op.ID, op.Target)
+	case RebalanceOp:
+		d.relayout(op.Positions, op.ID)
+	default:
+		return false
+	}
+	d.remember(orig)
+	d.observe(op.ID)
+	d.changed(orig)
+	d.tick()
+	if op.Kind == RebalanceOp {
+		deferred := d.deferred
+		d.deferred = nil
+		for _, op := range deferred {
+			d.apply(op)
+		}
+	}
+	d.autoRebalance()
+	return true
+}
+
+// Dropped returns the number of operations Apply dropped because they came from an
+// epoch too old to translate. The Document and the sites that applied them differ from
+// then on.
+func (d *Document) Dropped() int {
+	return d.dropped
+}
+
+// Applied reports whether the operation with the given ID has been applied to the
+// Document.
+func (d *Document) Applied(id OpID) bool {
+	return d.applied(id)
+}
+
+// applied reports whether the operation has been applied to the Document.
+func (d *Document) applied(id OpID) bool {
+	return d.version.Includes(id) || d.ahead[id]
+}
+
+// nextID is the identifier the next local operation will get.
+func (d *Document) nextID() OpID {
+	return OpID{d.clientID, d.clock + 1}
+}
+
+// insertLocal inserts a pair generated here and records the insert.
+func (d *Document) insertLocal(p []Identifier, atom string) bool {
+	if d.frozen || !d.insertPair(pair{pos: p, atom: atom, id: d.nextID()}) {
+		return false
+	}
+	d.record(Op{Kind: InsertOp, Epoch: d.epoch, Pos: p, Atom: atom})
+	d.track(edit{kind: InsertOp, pos: p, atom: atom})
+	return true
+}
+
+// deleteLocal deletes a pair on behalf of this site and records the delete.
+func (d *Document) deleteLocal(p []Identifier) bool {
+	i, exists := d.Index(p)
+	if d.frozen || !exists {
+		return false
+	}
+	target, atom, after := d.pairs[i].id, d.pairs[i].atom, d.pairs[i-1].pos
+	if !d.deleteID(p, d.nextID(), target) {
+		return false
+	}
+	d.record(Op{Kind: DeleteOp, Epoch: d.epoch, Pos: p, Target: target})
+	d.track(edit{kind: DeleteOp, pos: p, atom: atom, after: after})
+	return true
+}
+
+// record stamps a local operation that has just been applied with the next clock value
+// and queues it for broadcast, or stages it until the group it belongs to is committed.
+func (d *Document) record(op Op) {
+	op.ID = d.nextID()
+	op.Time = time.Now().UnixNano()
+	d.observe(op.ID)
+	if d.txn > 0 {
+		d.staged = append(d.staged, op)
+	} else {
+		d.outbox = append(d.outbox, op)
+		d.remember(op)
+		d.changed(op)
+	}
+	d.tick()
+}
+
+// observe marks the operation as applied.
+func (d *Document) observe(id OpID) {
+	if d.version == nil {
+		d.version = make(VersionVector)
+	}
+	if id.Site == d.clientID && id.Clock > d.clock {
+		d.clock = id.Clock
+	}
+	if id.Site != d.clientID {
+		d.knowSite(id.Site)
+	}
+	if id.Clock != d.version[id.Site]+1 {
+		if d.ahead == nil {
+			d.ahead = make(map[OpID]bool)
+		}
+		d.ahead[id] = true
+		return
+	}
+	d.version[id.Site] = id.Clock
+	for next := (OpID{id.Site, id.Clock + 1}); d.ahead[next]; next.Clock++ {
+		delete(d.ahead, next)
+		d.version[id.Site] = next.Clock
+	}
+}
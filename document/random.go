@@ -0,0 +1,33 @@
+package document
+
+// the randomness of position generation
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// rnd picks the identifiers of new positions. It replaces the global source of
+// math/rand, which newer Go versions no longer let rand.Seed reset, so that the
+// convergence harness can replay a failed run from its seed. Documents of several
+// goroutines draw from it at once, hence the lock.
+var rnd = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+
+// lockedSource is a rand.Source safe for use by several Documents at once.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,185 @@
+package document
+
+// DefaultRebalanceDepth is the average number of identifiers per position above which a
+// Document created by NewDocument rebalances.
+const DefaultRebalanceDepth = 8
+
+// layoutSpace is the number of values available to a layout at every level. The first
+// level of a position has to stay strictly between Start and End.
+const layoutSpace = 1<<16 - 2
+
+// layout describes a rebalance: the positions of the old epoch, in order, and how many
+// levels their replacements use. The i-th old position becomes the i-th of a set of
+// evenly spaced positions whose identifiers all belong to site 0.
+type layout struct {
+	old   [][]Identifier
+	width int
+	step  uint64
+}
+
+// newLayout spreads the positions over as few levels as they fit in.
+func newLayout(old [][]Identifier) *layout {
+	l := &layout{old: old, width: 1}
+	space := uint64(layoutSpace)
+	for space/uint64(len(old)+1) == 0 {
+		space <<= 16
+		l.width++
+	}
+	l.step = space / uint64(len(old)+1)
+	return l
+}
+
+// position returns the replacement of the i-th old position. For i == -1 it returns the
+// all-zero position just after Start.
+func (l *layout) position(i int) []Identifier {
+	p := make([]Identifier, l.width)
+	v := uint64(i+1) * l.step
+	for k := l.width - 1; k > 0; k-- {
+		p[k].Ident = uint16(v)
+		v >>= 16
+	}
+	if i >= 0 {
+		p[0].Ident = uint16(v) + 1
+	}
+	return p
+}
+
+// translate maps a position of the old epoch into the new one. A position that was not
+// rewritten, because it was inserted or deleted concurrently with the rebalance, is
+// appended to the replacement of the closest rewritten position on its left. This keeps
+// the order of all positions, and every site computes the same translation.
+func (l *layout) translate(p []Identifier) []Identifier {
+	lo, hi := 0, len(l.old) // find the first old position >= p
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if ComparePos(l.old[mid], p) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < len(l.old) && ComparePos(l.old[lo], p) == 0 {
+		return l.position(lo)
+	}
+	return append(l.position(lo-1), p...)
+}
+
+// Epoch returns the number of rebalances the Document went through. Positions obtained
+// in an earlier epoch are meaningless in the current one.
+func (d *Document) Epoch() uint32 {
+	return d.epoch
+}
+
+// Translate maps a position obtained in an earlier epoch into the current one. Only
+// positions of the current and the previous epoch can be translated.
+func (d *Document) Translate(p []Identifier, epoch uint32) ([]Identifier, bool) {
+	switch {
+	case epoch == d.epoch:
+		return p, true
+	case epoch+1 == d.epoch && d.prev != nil:
+		return d.prev.translate(p), true
+	}
+	return nil, false
+}
+
+// AverageDepth returns the average number of identifiers per position.
+func (d *Document) AverageDepth() float64 {
+	if len(d.pairs) == 0 {
+		return 0
+	}
+	return float64(d.ids) / float64(len(d.pairs))
+}
+
+// SetRebalanceDepth sets the average depth above which the Document rebalances on its
+// own. Zero turns automatic rebalancing off.
+func (d *Document) SetRebalanceDepth(depth float64) {
+	d.maxDepth = depth
+}
+
+// Rebalance rewrites every position into short, evenly spaced ones and starts a new
+// epoch, returning whether it did. The rebalance is an Op: peers apply the same rewrite
+// and translate the operations of the previous epoch still in flight.
+//
+// To avoid concurrent rebalances, only the coordinator, the known site with the lowest
+// ID, rebalances. It also waits until the previous rebalance is stable and every site
+// has seen all operations issued before it, so no peer ever has to translate an
+// operation older than the previous epoch.
+func (d *Document) Rebalance() bool {
+	if !d.coordinating() || !d.settled() {
+		return false
+	}
+	old := make([][]Identifier, 0, len(d.pairs))
+	for _, e := range d.pairs[1 : len(d.pairs)-1] {
+		old = append(old, e.pos)
+	}
+	op := Op{Kind: RebalanceOp, ID: d.nextID(), Epoch: d.epoch, Positions: old}
+	d.relayout(old, op.ID)
+	d.record(op)
+	return true
+}
+
+// autoRebalance rebalances if positions got too deep. It only runs between operations,
+// since a rebalance invalidates the positions a caller may hold during one.
+func (d *Document) autoRebalance() {
+	if d.maxDepth > 0 && d.AverageDepth() > d.maxDepth {
+		d.Rebalance()
+	}
+}
+
+// coordinating reports whether this site has the lowest ID among the known sites.
+func (d *Document) coordinating() bool {
+	for site := range d.peers {
+		if site < d.clientID {
+			return false
+		}
+	}
+	return true
+}
+
+// settled reports whether every known site applied the last rebalance, and every site
+// has applied all operations the others issued in the previous epoch.
+func (d *Document) settled() bool {
+	if d.rebalance.Clock == 0 {
+		return true
+	}
+	for site := range d.peers {
+		if _, bounded := d.bounds[site]; !bounded {
+			return false
+		}
+	}
+	for site, bound := range d.bounds {
+		if d.version[site] < bound {
+			return false
+		}
+		for _, vv := range d.peers {
+			if vv[site] < bound {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// relayout rewrites the positions of the Document with the layout of old, the positions
+// of the rebalance id, and starts a new epoch.
+func (d *Document) relayout(old [][]Identifier, id OpID) {
+	l := newLayout(old)
+	d.ids, d.merkle = 0, nil
+	for i := range d.pairs {
+		if i > 0 && i < len(d.pairs)-1 { // Start and End do not move
+			d.pairs[i].pos = l.translate(d.pairs[i].pos)
+		}
+		d.added(d.pairs[i])
+	}
+	tombstones := make(map[string]tombstone, len(d.tombstones))
+	for _, t := range d.tombstones {
+		t.pos = l.translate(t.pos)
+		tombstones[string(PosBytes(t.pos))] = t
+	}
+	d.tombstones = tombstones
+	d.translateEdits(l)
+	d.prev = l
+	d.epoch++
+	d.rebalance = id
+	d.bounds = VersionVector{d.clientID: d.clock}
+}
@@ -0,0 +1,108 @@
+package document
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestLayoutKeepsOrder(t *testing.T) {
+	old := [][]Identifier{
+		{{5, 1}},
+		{{5, 1}, {700, 2}},
+		{{9, 1}, {3, 1}, {65535, 4}},
+	}
+	for _, n := range []int{len(old), 70000} { // one and two levels
+		l := newLayout(old)
+		if n > len(old) {
+			l = newLayout(make([][]Identifier, n))
+			l.old = old
+		}
+		var last []Identifier = Start
+		for _, p := range [][]Identifier{
+			{{1, 1}}, old[0], {{5, 1}, {3, 3}}, old[1], {{6, 2}}, old[2], {{10, 1}},
+		} {
+			np := l.translate(p)
+			assert.Equal(t, ComparePos(last, np), int8(-1))
+			last = np
+		}
+		assert.Equal(t, ComparePos(last, End), int8(-1))
+	}
+}
+
+func TestOpsTwoEpochsBehindAreDropped(t *testing.T) {
+	doc1 := NewDocument(strings.Split("abc", ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	doc2.InsertLeft(doc2.pairs[2].pos, "y")
+	late := doc2.TakeOps()
+
+	assert.Assert(t, doc1.Rebalance())
+	assert.Assert(t, doc1.Rebalance())
+	assert.Equal(t, doc1.Epoch(), uint32(2))
+	assert.Equal(t, doc1.Apply(late[0]), false)
+	assert.Equal(t, doc1.Content(), "abc")
+	assert.Equal(t, doc1.Dropped(), 1)
+
+	// so is a rebalance of the previous epoch, it would undo the current one
+	assert.Equal(t, doc1.Apply(Op{Kind: RebalanceOp, ID: OpID{3, 1}, Epoch: 1}), false)
+	assert.Equal(t, doc1.Dropped(), 2)
+}
+
+func TestRebalanceTranslatesConcurrentOps(t *testing.T) {
+	doc1 := NewDocument(strings.Split("abc", ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	doc1.ObserveVersion(2, nil)
+	doc2.ObserveVersion(1, nil)
+
+	// dig deep positions by always typing in front of the previous character
+	p := doc1.pairs[2].pos
+	for i := 0; i < 40; i++ {
+		p, _ = doc1.InsertLeft(p, "x")
+	}
+	for _, op := range doc1.TakeOps() {
+		doc2.Apply(op)
+	}
+	deep := doc1.AverageDepth()
+
+	// doc2 types while doc1 rebalances
+	held := doc2.pairs[5].pos
+	doc2.InsertLeft(doc2.pairs[3].pos, "y")
+	doc2.DeleteRight(Start)
+	concurrent := doc2.TakeOps()
+
+	assert.Equal(t, doc2.Rebalance(), false) // only the coordinator rebalances
+	assert.Equal(t, doc1.Rebalance(), true)
+	assert.Assert(t, doc1.AverageDepth() < deep)
+	rebalance := doc1.TakeOps()
+
+	for _, op := range concurrent {
+		doc1.Apply(op) // old epoch, translated
+	}
+	for _, op := range rebalance {
+		doc2.Apply(op)
+	}
+	assert.Equal(t, doc1.Epoch(), uint32(1))
+	assert.Equal(t, doc2.Epoch(), uint32(1))
+	np, ok := doc2.Translate(held, 0)
+	assert.Assert(t, ok)
+	atom, _ := doc2.Get(np)
+	assert.Equal(t, atom, "x")
+	_, ok = doc2.Translate(held, 2)
+	assert.Assert(t, !ok)
+	assert.Equal(t, doc1.Content(), doc2.Content())
+	for i, e := range doc1.pairs {
+		assert.Equal(t, ComparePos(e.pos, doc2.pairs[i].pos), int8(0))
+	}
+
+	// a second rebalance waits until doc2 reports it has moved to the new epoch
+	assert.Equal(t, doc1.Rebalance(), false)
+	doc1.ObserveVersion(2, doc2.Version())
+	assert.Equal(t, doc1.Rebalance(), true)
+}
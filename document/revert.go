@@ -0,0 +1,100 @@
+package document
+
+import "fmt"
+
+// Revert undoes the given operations of the history, of any site, and leaves the others
+// alone. Reverting an operation of a group reverts the whole group. An insert is undone
+// by deleting the character, unless it is deleted already, and a delete by inserting the
+// character again at a new position between its neighbours, wherever they are now. The
+// operations this generates are taken with TakeOps like any other, and the whole revert
+// can itself be undone with Undo.
+func (d *Document) Revert(ids ...OpID) error {
+	var unit []edit
+	for _, id := range d.groups(ids) {
+		op, ok := d.HistoryOp(id)
+		if !ok {
+			return fmt.Errorf("document: operation %d.%d is not in the history", id.Site, id.Clock)
+		}
+		e := edit{kind: op.Kind, pos: d.current(op.Pos, op.Epoch)}
+		switch op.Kind {
+		case InsertOp:
+			e.atom = op.Atom
+		case DeleteOp:
+			if e.atom, ok = d.atomAt(e.pos, op.Target); !ok {
+				return fmt.Errorf("document: character deleted by %d.%d is unknown", id.Site, id.Clock)
+			}
+		default:
+			return fmt.Errorf("document: operation %d.%d cannot be reverted", id.Site, id.Clock)
+		}
+		unit = append(unit, e)
+	}
+	if done := d.revert(unit); len(done) > 0 {
+		d.undo = append(d.undo, done)
+		d.redo = nil
+		d.closed = true
+	}
+	return nil
+}
+
+// groups returns the operations, with the other operations of their groups.
+func (d *Document) groups(ids []OpID) []OpID {
+	var all []OpID
+	seen := make(map[OpID]bool)
+	for _, id := range ids {
+		group := []OpID{id}
+		if op, ok := d.HistoryOp(id); ok && op.GroupSize > 0 {
+			group = group[:0]
+			for c := uint64(0); c < uint64(op.GroupSize); c++ {
+				member := OpID{op.Group.Site, op.Group.Clock + c}
+				if op, _ := d.HistoryOp(member); op.Kind != RebalanceOp {
+					group = append(group, member) // a rebalance in the group changed no content
+				}
+			}
+		}
+		for _, id := range group {
+			if !seen[id] {
+				seen[id] = true
+				all = append(all, id)
+			}
+		}
+	}
+	return all
+}
+
+// current translates a position of the given epoch through the rebalances applied since.
+func (d *Document) current(p []Identifier, epoch uint32) []Identifier {
+	for _, l := range d.layouts(epoch) {
+		p = l.translate(p)
+	}
+	return p
+}
+
+// layouts returns the layouts of the rebalances applied since the given epoch, in order.
+func (d *Document) layouts(epoch uint32) []*layout {
+	var ls []*layout
+	for _, op := range d.history {
+		if op.Kind == RebalanceOp && op.Epoch >= epoch {
+			ls = append(ls, newLayout(op.Positions))
+		}
+	}
+	return ls
+}
+
+// atomAt returns the character the insert id put at p, a position of the current epoch.
+// Content that did not come from an Op is looked up by position.
+func (d *Document) atomAt(p []Identifier, id OpID) (string, bool) {
+	if op, ok := d.HistoryOp(id); ok && op.Kind == InsertOp {
+		return op.Atom, true
+	}
+	ls := d.layouts(0)
+	for _, e := range d.base {
+		q := e.pos
+		for _, l := range ls {
+			q = l.translate(q)
+		}
+		if ComparePos(q, p) == 0 {
+			return e.atom, true
+		}
+	}
+	return "", false
+}
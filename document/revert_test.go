@@ -0,0 +1,83 @@
+package document
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// IDs of the operations of the history of doc from index from on, and the length of the
+// history
+func issued(doc *Document, from int) ([]OpID, int) {
+	var ids []OpID
+	history := doc.History()
+	for _, op := range history[from:] {
+		ids = append(ids, op.ID)
+	}
+	return ids, len(history)
+}
+
+func TestRevertTeammatePaste(t *testing.T) {
+	doc1, doc2 := undoPeers("Entangle")
+	_, n := issued(doc2, 0)
+	p, _ := doc2.InsertLeft(End, " ")
+	for _, c := range "pasted" {
+		p, _ = doc2.InsertRight(p, string(c))
+	}
+	paste, _ := issued(doc2, n)
+	exchange(doc1, doc2)
+
+	// later edits, one of them in the middle of the paste
+	doc1.InsertLeft(End, "!")
+	doc1.DeleteRight(Start)
+	doc1.InsertRight(Start, "e")
+	exchange(doc1, doc2)
+	i, _ := doc1.Index(p)
+	doc1.InsertLeft(doc1.pairs[i].pos, "_")
+	exchange(doc1, doc2)
+	assert.Equal(t, doc1.Content(), "entangle paste_d!")
+
+	assert.NilError(t, doc1.Revert(paste...))
+	assert.Equal(t, doc1.Content(), "entangle_!")
+	exchange(doc1, doc2)
+	assert.Equal(t, doc2.Content(), doc1.Content())
+
+	// the revert is a local edit
+	assert.Assert(t, doc1.Undo())
+	assert.Equal(t, doc1.Content(), "entangle paste_d!")
+	exchange(doc1, doc2)
+	assert.Equal(t, doc2.Content(), doc1.Content())
+}
+
+func TestRevertDelete(t *testing.T) {
+	doc1, doc2 := undoPeers("Entangle")
+	doc2.DeleteRight(Start)
+	doc2.DeleteLeft(End)
+	deletes, n := issued(doc2, 0)
+	doc2.InsertRight(doc2.pairs[2].pos, "!")
+	inserted, _ := issued(doc2, n)
+	exchange(doc1, doc2)
+	assert.Equal(t, doc1.Content(), "nt!angl")
+	assert.Assert(t, doc1.Rebalance())
+	exchange(doc1, doc2)
+
+	assert.NilError(t, doc1.Revert(deletes...))
+	assert.Equal(t, doc1.Content(), "Ent!angle")
+	exchange(doc1, doc2)
+	assert.Equal(t, doc2.Content(), doc1.Content())
+
+	// reverting twice does nothing more, nor does reverting what is gone already
+	_, n = issued(doc1, 0)
+	assert.NilError(t, doc1.Revert(inserted...))
+	assert.NilError(t, doc1.Revert(inserted...))
+	ops, _ := issued(doc1, n)
+	assert.Equal(t, len(ops), 1)
+	assert.Equal(t, doc1.Content(), "Entangle")
+}
+
+func TestRevertUnknown(t *testing.T) {
+	doc, _ := undoPeers("Entangle")
+	assert.ErrorContains(t, doc.Revert(OpID{Site: 2, Clock: 1}), "not in the history")
+	assert.Assert(t, doc.Rebalance())
+	assert.ErrorContains(t, doc.Revert(doc.History()[0].ID), "cannot be reverted")
+}
@@ -0,0 +1,183 @@
+package document
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf8"
+)
+
+// MarshalOps encodes a list of operations, for instance a batch sent to a peer, more
+// compactly than one by one. A run of inserts of single characters typed one after the
+// other, whose positions only differ in the last identifier, is encoded as the first
+// position, the offsets of the last identifier from one character to the next, and the
+// string of the characters.
+//
+// The encoding is a list of records, each starting with the number of operations it
+// holds. A record of one operation holds its MarshalBinary encoding; a record of more is
+// a run.
+func MarshalOps(ops []Op) ([]byte, error) {
+	return marshalOps(ops, appendPos)
+}
+
+// MarshalOpsVarint encodes a list of operations like MarshalOps, with the positions
+// encoded by PosVarint.
+func MarshalOpsVarint(ops []Op) ([]byte, error) {
+	return marshalOps(ops, appendPosVarint)
+}
+
+// marshalOps encodes a list of operations, with their positions appended by pos.
+func marshalOps(ops []Op, pos func(b []byte, p []Identifier) []byte) ([]byte, error) {
+	var b []byte
+	for len(ops) > 0 {
+		n := 1
+		for n < len(ops) && continues(ops[n-1], ops[n]) {
+			n++
+		}
+		b = binary.AppendUvarint(b, uint64(n))
+		if n == 1 {
+			enc, err := ops[0].marshal(pos)
+			if err != nil {
+				return nil, err
+			}
+			b = binary.AppendUvarint(b, uint64(len(enc)))
+			b = append(b, enc...)
+		} else {
+			b = appendRun(b, ops[:n], pos)
+		}
+		ops = ops[n:]
+	}
+	return b, nil
+}
+
+// UnmarshalOps decodes operations encoded by MarshalOps.
+func UnmarshalOps(b []byte) ([]Op, error) {
+	return unmarshalOps(reader{b: b})
+}
+
+// UnmarshalOpsVarint decodes operations encoded by MarshalOpsVarint.
+func UnmarshalOpsVarint(b []byte) ([]Op, error) {
+	return unmarshalOps(reader{b: b, varintPos: true})
+}
+
+// unmarshalOps decodes the operations read by r.
+func unmarshalOps(r reader) ([]Op, error) {
+	var ops []Op
+	for len(r.b) > 0 && r.err == nil {
+		n := r.uvarint()
+		if n > uint64(len(r.b)) { // every operation takes a byte at least
+			return nil, errTruncated
+		}
+		if n == 0 {
+			return nil, errors.New("document: empty record of operations")
+		}
+		if n == 1 {
+			var op Op
+			if err := op.unmarshal(reader{b: r.bytes(r.uvarint()), varintPos: r.varintPos}); err != nil {
+				return nil, err
+			}
+			ops = append(ops, op)
+			continue
+		}
+		ops = r.run(ops, int(n))
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return ops, nil
+}
+
+// continues reports whether the insert b was typed right after a, so that they can be
+// encoded in the same run.
+func continues(a, b Op) bool {
+	if !runnable(a) || !runnable(b) || len(a.Pos) != len(b.Pos) {
+		return false
+	}
+	if b.ID != (OpID{a.ID.Site, a.ID.Clock + 1}) || b.Epoch != a.Epoch || b.Group != a.Group || b.GroupSize != a.GroupSize {
+		return false
+	}
+	last := len(a.Pos) - 1
+	for i := range a.Pos[:last] {
+		if a.Pos[i] != b.Pos[i] {
+			return false
+		}
+	}
+	return a.Pos[last].Site == b.Pos[last].Site
+}
+
+// runnable reports whether the operation may be part of a run: an insert of one
+// character, which a string of them gives back.
+func runnable(op Op) bool {
+	return op.Kind == InsertOp && len(op.Pos) > 0 && len(op.Pos) <= 255 &&
+		utf8.RuneCountInString(op.Atom) == 1 && utf8.ValidString(op.Atom) &&
+		op.Target == (OpID{}) && op.Positions == nil
+}
+
+// appendRun appends the record of a run of inserts.
+func appendRun(b []byte, ops []Op, pos func(b []byte, p []Identifier) []byte) []byte {
+	first := ops[0]
+	b = append(b, first.ID.Site)
+	b = binary.AppendUvarint(b, first.ID.Clock)
+	b = binary.AppendUvarint(b, uint64(first.Epoch))
+	b = append(b, first.Group.Site)
+	b = binary.AppendUvarint(b, first.Group.Clock)
+	b = binary.AppendUvarint(b, uint64(first.GroupSize))
+	b = pos(b, first.Pos)
+	var text []byte
+	for _, op := range ops {
+		text = append(text, op.Atom...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(text)))
+	b = append(b, text...)
+	last := len(first.Pos) - 1
+	for i := 1; i < len(ops); i++ {
+		b = binary.AppendVarint(b, int64(ops[i].Pos[last].Ident)-int64(ops[i-1].Pos[last].Ident))
+	}
+	b = binary.AppendVarint(b, first.Time)
+	for i := 1; i < len(ops); i++ {
+		b = binary.AppendVarint(b, ops[i].Time-ops[i-1].Time)
+	}
+	return b
+}
+
+// run decodes the record of a run of n inserts and appends them to ops.
+func (r *reader) run(ops []Op, n int) []Op {
+	var first Op
+	first.Kind = InsertOp
+	first.ID.Site = r.byte()
+	first.ID.Clock = r.uvarint()
+	first.Epoch = uint32(r.uvarint())
+	first.Group.Site = r.byte()
+	first.Group.Clock = r.uvarint()
+	first.GroupSize = uint32(r.uvarint())
+	first.Pos = r.pos()
+	text := string(r.bytes(r.uvarint()))
+	if r.err == nil && (first.Pos == nil || !utf8.ValidString(text) || utf8.RuneCountInString(text) != n) {
+		r.err = errors.New("document: bad run of operations")
+	}
+	if r.err != nil {
+		return ops
+	}
+
+	last := len(first.Pos) - 1
+	start := len(ops)
+	for i, c := range text {
+		op := first
+		op.ID.Clock += uint64(len(ops) - start)
+		op.Atom = text[i : i+utf8.RuneLen(c)]
+		if len(ops) > start {
+			prev := ops[len(ops)-1].Pos
+			ident := int64(prev[last].Ident) + r.varint()
+			if ident < 0 || ident > 65535 {
+				r.err = errors.New("document: bad run of operations")
+				return ops
+			}
+			op.Pos = append(append([]Identifier(nil), prev[:last]...), Identifier{uint16(ident), prev[last].Site})
+		}
+		ops = append(ops, op)
+	}
+	ops[start].Time = r.varint()
+	for i := start + 1; i < len(ops); i++ {
+		ops[i].Time = ops[i-1].Time + r.varint()
+	}
+	return ops
+}
@@ -0,0 +1,54 @@
+package document
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestOpsRoundTrip(t *testing.T) {
+	doc := NewDocument([]string{"a", "b"}, 1)
+	p := doc.pairs[1].pos
+	for _, c := range "typing a few wörds, then some more" {
+		p, _ = doc.InsertRight(p, string(c))
+	}
+	p, _ = doc.InsertLeft(p, "in the middle")
+	doc.DeleteRight(Start)
+	replace(doc, 3, 6, "grouped")
+	doc.InsertLeft(End, "\xff")
+	doc.Rebalance()
+	for _, c := range "after" {
+		p, _ = doc.InsertLeft(End, string(c))
+	}
+	ops := doc.TakeOps()
+
+	b, err := MarshalOps(ops)
+	assert.NilError(t, err)
+	got, err := UnmarshalOps(b)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, ops)
+
+	var single int
+	for _, op := range ops {
+		enc, _ := op.MarshalBinary()
+		single += len(enc)
+	}
+	assert.Assert(t, len(b) < single/2, "%d bytes, %d one by one", len(b), single)
+
+	v, err := MarshalOpsVarint(ops)
+	assert.NilError(t, err)
+	got, err = UnmarshalOpsVarint(v)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, ops)
+
+	// a cut at the end of a record loses the operations after it, any other is reported
+	for i := range b {
+		got, err := UnmarshalOps(b[:i])
+		if err == nil && len(got) > 0 {
+			assert.DeepEqual(t, got, ops[:len(got)])
+		}
+	}
+	got, err = UnmarshalOps(nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(got), 0)
+}
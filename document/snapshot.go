@@ -0,0 +1,222 @@
+package document
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// snapshotVersion is the first byte of a snapshot, bumped when the encoding changes.
+const snapshotVersion = 3
+
+// MarshalBinary encodes the whole state of the Document: its pairs and tombstones, what
+// it has applied and what it knows of its peers, so that a Document restored by
+// UnmarshalBinary carries on exactly where this one was. The history is left out, it
+// holds every operation ever applied and whoever keeps them gives it back with
+// SetHistory.
+func (d *Document) MarshalBinary() ([]byte, error) {
+	b := []byte{snapshotVersion, d.clientID}
+	b = binary.AppendUvarint(b, d.clock)
+	b = binary.AppendUvarint(b, uint64(d.epoch))
+	b = binary.BigEndian.AppendUint64(b, math.Float64bits(d.maxDepth))
+	b = binary.AppendUvarint(b, uint64(d.gc.Collected))
+	b = binary.AppendUvarint(b, uint64(d.gc.Runs))
+
+	b = appendVersion(b, d.version)
+	b = binary.AppendUvarint(b, uint64(len(d.ahead)))
+	for id := range d.ahead {
+		b = appendID(b, id)
+	}
+	b = binary.AppendUvarint(b, uint64(len(d.peers)))
+	for site, vv := range d.peers {
+		b = append(b, site)
+		b = appendVersion(b, vv)
+	}
+	b = appendID(b, d.rebalance)
+	b = appendVersion(b, d.bounds)
+	b = appendVersion(b, d.floor)
+
+	b = binary.AppendUvarint(b, uint64(len(d.pairs)))
+	for _, e := range d.pairs {
+		if len(e.pos) > 255 {
+			return nil, errors.New("document: position too long to encode")
+		}
+		b = appendPos(b, e.pos)
+		b = binary.AppendUvarint(b, uint64(len(e.atom)))
+		b = append(b, e.atom...)
+		b = appendID(b, e.id)
+	}
+	b = binary.AppendUvarint(b, uint64(len(d.tombstones)))
+	for _, t := range d.tombstones {
+		if len(t.pos) > 255 {
+			return nil, errors.New("document: position too long to encode")
+		}
+		b = appendPos(b, t.pos)
+		b = appendID(b, t.id)
+		if t.seen {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	b = binary.AppendUvarint(b, uint64(len(d.retired)))
+	for h := range d.retired {
+		b = binary.BigEndian.AppendUint64(b, h)
+	}
+
+	// the layout of the previous epoch is rebuilt from the positions it rewrote
+	var old [][]Identifier
+	if d.prev != nil {
+		old = d.prev.old
+	}
+	prev, err := Op{Positions: old}.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b = binary.AppendUvarint(b, uint64(len(prev)))
+	b = append(b, prev...)
+	if d.prev == nil {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(d.base)))
+	for _, e := range d.base {
+		b = appendPos(b, e.pos)
+		b = binary.AppendUvarint(b, uint64(len(e.atom)))
+		b = append(b, e.atom...)
+	}
+	for _, ops := range [][]Op{d.deferred, d.log, d.outbox} {
+		b = binary.AppendUvarint(b, uint64(len(ops)))
+		for _, op := range ops {
+			enc, err := op.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			b = binary.AppendUvarint(b, uint64(len(enc)))
+			b = append(b, enc...)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary restores a Document encoded by MarshalBinary, replacing its state.
+func (d *Document) UnmarshalBinary(b []byte) error {
+	r := reader{b: b}
+	if v := r.byte(); r.err == nil && v != snapshotVersion {
+		return errors.New("document: unknown snapshot version")
+	}
+	n := Document{tombstones: make(map[string]tombstone)}
+	n.clientID = r.byte()
+	n.clock = r.uvarint()
+	n.epoch = uint32(r.uvarint())
+	n.maxDepth = math.Float64frombits(r.uint64())
+	n.gc.Collected = int(r.uvarint())
+	n.gc.Runs = int(r.uvarint())
+
+	n.version = r.version()
+	for i, count := 0, r.uvarint(); r.err == nil && uint64(i) < count; i++ {
+		if n.ahead == nil {
+			n.ahead = make(map[OpID]bool)
+		}
+		n.ahead[r.id()] = true
+	}
+	for i, count := 0, r.uvarint(); r.err == nil && uint64(i) < count; i++ {
+		site := r.byte()
+		n.knowSite(site)
+		n.peers[site] = r.version()
+	}
+	n.rebalance = r.id()
+	n.bounds = r.version()
+	n.floor = r.version()
+
+	for i, count := 0, r.uvarint(); r.err == nil && uint64(i) < count; i++ {
+		e := pair{pos: r.pos()}
+		e.atom = string(r.bytes(r.uvarint()))
+		e.id = r.id()
+		if r.err != nil {
+			break
+		}
+		if len(e.pos) == 0 || len(n.pairs) > 0 && ComparePos(n.pairs[len(n.pairs)-1].pos, e.pos) >= 0 {
+			return errors.New("document: snapshot pairs out of order")
+		}
+		n.pairs = append(n.pairs, e)
+		n.added(e)
+	}
+	for i, count := 0, r.uvarint(); r.err == nil && uint64(i) < count; i++ {
+		t := tombstone{pos: r.pos(), id: r.id(), seen: r.byte() == 1}
+		n.tombstones[string(PosBytes(t.pos))] = t
+	}
+	for i, count := 0, r.uvarint(); r.err == nil && uint64(i) < count; i++ {
+		if n.retired == nil {
+			n.retired = make(map[uint64]bool)
+		}
+		n.retired[r.uint64()] = true
+	}
+
+	var prev Op
+	if err := prev.UnmarshalBinary(r.bytes(r.uvarint())); r.err == nil && err != nil {
+		return err
+	}
+	if r.byte() == 1 {
+		n.prev = newLayout(prev.Positions)
+	}
+
+	for i, count := 0, r.uvarint(); r.err == nil && uint64(i) < count; i++ {
+		e := pair{pos: r.pos()}
+		e.atom = string(r.bytes(r.uvarint()))
+		n.base = append(n.base, e)
+	}
+	for _, ops := range []*[]Op{&n.deferred, &n.log, &n.outbox} {
+		for i, count := 0, r.uvarint(); r.err == nil && uint64(i) < count; i++ {
+			var op Op
+			if err := op.UnmarshalBinary(r.bytes(r.uvarint())); r.err == nil && err != nil {
+				return err
+			}
+			*ops = append(*ops, op)
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(n.pairs) < 2 || ComparePos(n.pairs[0].pos, Start) != 0 || ComparePos(n.pairs[len(n.pairs)-1].pos, End) != 0 {
+		return errors.New("document: snapshot without Start and End")
+	}
+	*d = n
+	return nil
+}
+
+// appendID appends an operation ID.
+func appendID(b []byte, id OpID) []byte {
+	return binary.AppendUvarint(append(b, id.Site), id.Clock)
+}
+
+// appendVersion appends a version vector.
+func appendVersion(b []byte, vv VersionVector) []byte {
+	b = binary.AppendUvarint(b, uint64(len(vv)))
+	for site, clock := range vv {
+		b = appendID(b, OpID{site, clock})
+	}
+	return b
+}
+
+func (r *reader) id() OpID {
+	return OpID{Site: r.byte(), Clock: r.uvarint()}
+}
+
+func (r *reader) version() VersionVector {
+	vv := make(VersionVector)
+	for i, count := 0, r.uvarint(); r.err == nil && uint64(i) < count; i++ {
+		id := r.id()
+		vv[id.Site] = id.Clock
+	}
+	return vv
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
@@ -0,0 +1,52 @@
+package document
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	c := diverge(clusterConfig{
+		Replicas:  3,
+		Steps:     500,
+		Content:   "abc",
+		InsertPct: 75,
+		DupPct:    20,
+		DelayPct:  60,
+		Atoms:     "xyz",
+		GCPct:     30,
+		Rebalance: 1.5,
+	}, 7)
+
+	for r, d := range c.replicas {
+		b, err := d.MarshalBinary()
+		assert.NilError(t, err)
+		var restored Document
+		assert.NilError(t, restored.UnmarshalBinary(b))
+		assert.Equal(t, stateDiff(d, &restored), "", "replica %d", r)
+		assert.Equal(t, restored.SiteID(), d.SiteID())
+		assert.Equal(t, restored.GCStats(), d.GCStats())
+		assert.Equal(t, restored.Digest(MerkleRoot), d.Digest(MerkleRoot))
+		assert.Equal(t, restored.AverageDepth(), d.AverageDepth())
+		c.replicas[r] = &restored
+	}
+
+	// restored replicas carry on as if nothing happened
+	c.drain()
+	assert.Equal(t, c.diverged(), "")
+}
+
+func TestSnapshotTruncated(t *testing.T) {
+	d := NewDocument(strings.Split("abc", ""), 1)
+	d.ObserveVersion(2, VersionVector{2: 3})
+	p, _ := d.InsertRight(Start, "x")
+	d.DeleteRight(p)
+	b, err := d.MarshalBinary()
+	assert.NilError(t, err)
+	for i := range b {
+		var restored Document
+		assert.Assert(t, restored.UnmarshalBinary(b[:i]) != nil, "%d bytes", i)
+	}
+}
@@ -0,0 +1,48 @@
+package document
+
+// OpsSince returns the operations applied here that the version vector does not include,
+// in the order they were applied, so that a peer reporting vv can catch up by applying
+// them. The cost is proportional to what the peer missed, not to the size of the
+// Document.
+//
+// It returns false if the peer misses operations that were already dropped from the log
+// because every known site had them. This only happens to a site that is not known
+// here, such as a newcomer or a site that was forgotten, and it needs a full copy of the
+// Document instead.
+func (d *Document) OpsSince(vv VersionVector) ([]Op, bool) {
+	for site, clock := range d.floor {
+		if vv[site] < clock {
+			return nil, false
+		}
+	}
+	var ops []Op
+	for _, op := range d.log {
+		if !vv.Includes(op.ID) {
+			ops = append(ops, op)
+		}
+	}
+	return ops, true
+}
+
+// trimLog drops the operations every known site has applied from the log. Stable
+// operations of a site always form a prefix of its clock values, so the floor records
+// the highest clock dropped per site.
+func (d *Document) trimLog() {
+	kept := d.log[:0]
+	for _, op := range d.log {
+		if !d.stable(op.ID) {
+			kept = append(kept, op)
+			continue
+		}
+		if d.floor == nil {
+			d.floor = make(VersionVector)
+		}
+		if op.ID.Clock > d.floor[op.ID.Site] {
+			d.floor[op.ID.Site] = op.ID.Clock
+		}
+	}
+	for i := len(kept); i < len(d.log); i++ {
+		d.log[i] = Op{} // let dropped positions be collected
+	}
+	d.log = kept
+}
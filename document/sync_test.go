@@ -0,0 +1,72 @@
+package document
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestOpsSinceCatchesUpAfterPartition(t *testing.T) {
+	doc1 := NewDocument(strings.Split(strings.Repeat("entangle ", 100), ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	doc1.ObserveVersion(2, nil)
+	doc2.ObserveVersion(1, nil)
+
+	// both sides keep editing while disconnected
+	p1 := doc1.pairs[5].pos
+	for i := 0; i < 10; i++ {
+		p1, _ = doc1.InsertRight(p1, "a")
+	}
+	doc1.DeleteRight(Start)
+	p2 := doc2.pairs[300].pos
+	for i := 0; i < 5; i++ {
+		p2, _ = doc2.InsertRight(p2, "b")
+	}
+	doc2.DeleteLeft(End)
+	doc1.TakeOps()
+	doc2.TakeOps()
+
+	// on reconnect, each side asks for what it is missing
+	ops1, ok1 := doc2.OpsSince(doc1.Version())
+	ops2, ok2 := doc1.OpsSince(doc2.Version())
+	assert.Assert(t, ok1 && ok2)
+	assert.Equal(t, len(ops1), 6)
+	assert.Equal(t, len(ops2), 11)
+	for _, op := range ops1 {
+		doc1.Apply(op)
+	}
+	for _, op := range ops2 {
+		doc2.Apply(op)
+	}
+	assert.Equal(t, doc1.Content(), doc2.Content())
+
+	// nothing is missing anymore
+	ops, ok := doc1.OpsSince(doc2.Version())
+	assert.Assert(t, ok)
+	assert.Equal(t, len(ops), 0)
+}
+
+func TestOpsSinceAfterTrim(t *testing.T) {
+	doc1 := NewDocument(strings.Split("abc", ""), 1)
+	doc1.ObserveVersion(2, nil)
+	p, _ := doc1.InsertRight(Start, "x")
+	doc1.InsertRight(p, "y")
+
+	// site 2 has the first insert only
+	doc1.ObserveVersion(2, VersionVector{1: 1})
+	doc1.CollectGarbage()
+	assert.Equal(t, len(doc1.log), 1)
+
+	ops, ok := doc1.OpsSince(VersionVector{1: 1})
+	assert.Assert(t, ok)
+	assert.Equal(t, len(ops), 1)
+	assert.Equal(t, ops[0].Atom, "y")
+
+	// a site that was never known misses the dropped insert
+	_, ok = doc1.OpsSince(nil)
+	assert.Equal(t, ok, false)
+}
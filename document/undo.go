@@ -0,0 +1,151 @@
+package document
+
+import (
+	"sort"
+	"time"
+)
+
+// undoWindow is how close in time local edits of the same kind must be to be undone
+// together, so that undo removes a typed word rather than a single keystroke.
+var undoWindow = time.Second
+
+// edit is a local insert or delete, as remembered for undo.
+type edit struct {
+	kind  OpKind
+	pos   []Identifier
+	atom  string
+	after []Identifier // of a delete, the character left of it then, nil if unknown
+}
+
+// Undo reverts the last unit of local edits that is still visible, and returns whether
+// there was one. Edits of other sites are never undone: an inserted character a peer
+// deleted since stays deleted. Undoing an insert deletes the character, and undoing a
+// delete inserts the character again at a new position between its neighbours. The
+// operations this generates are taken with TakeOps like any other.
+func (d *Document) Undo() bool {
+	for len(d.undo) > 0 {
+		unit := d.undo[len(d.undo)-1]
+		d.undo = d.undo[:len(d.undo)-1]
+		if done := d.revert(unit); len(done) > 0 {
+			d.redo = append(d.redo, done)
+			d.closed = true
+			return true
+		}
+	}
+	return false
+}
+
+// Redo reverts the last Undo, if no local edit happened since, and returns whether
+// there was one to revert.
+func (d *Document) Redo() bool {
+	for len(d.redo) > 0 {
+		unit := d.redo[len(d.redo)-1]
+		d.redo = d.redo[:len(d.redo)-1]
+		if done := d.revert(unit); len(done) > 0 {
+			d.undo = append(d.undo, done)
+			d.closed = true
+			return true
+		}
+	}
+	return false
+}
+
+// CloseUndoUnit makes the next local edit start a new undo unit, however soon it
+// comes.
+func (d *Document) CloseUndoUnit() {
+	d.closed = true
+}
+
+// track remembers a local edit for undo.
+func (d *Document) track(e edit) {
+	if d.reverting {
+		d.reverted = append(d.reverted, e)
+		return
+	}
+	d.redo = nil
+	now := time.Now()
+	if n := len(d.undo); n > 0 && !d.closed && d.undo[n-1][0].kind == e.kind && now.Sub(d.lastEdit) < undoWindow {
+		d.undo[n-1] = append(d.undo[n-1], e)
+	} else {
+		d.undo = append(d.undo, []edit{e})
+	}
+	d.lastEdit = now
+	d.closed = false
+}
+
+// revert reverts a unit of edits and returns the edits that did it.
+func (d *Document) revert(unit []edit) []edit {
+	// the edits left to revert are kept in d.pending, where a rebalance triggered by
+	// one of them translates the others
+	d.reverting, d.reverted = true, nil
+	d.pending = append([]edit(nil), unit...)
+	d.Begin()
+	defer func() {
+		d.reverting, d.pending = false, nil
+		d.Commit()
+	}()
+
+	for i := len(d.pending) - 1; i >= 0; i-- {
+		if d.pending[i].kind == InsertOp {
+			d.deleteLocal(d.pending[i].pos) // nothing to do if a peer deleted it
+		}
+	}
+
+	// reinsert in order, each character after the one reinserted before it, wherever
+	// new positions landed
+	sort.SliceStable(d.pending, func(i, j int) bool { return ComparePos(d.pending[i].pos, d.pending[j].pos) < 0 })
+	last := -1
+	for k := range d.pending {
+		e := d.pending[k]
+		if e.kind != DeleteOp {
+			continue
+		}
+		i, _ := d.Index(e.pos)
+		if j, ok := d.Index(e.after); ok && e.after != nil {
+			i = j + 1 // next to its old neighbour, not next to what peers put there since
+		}
+		if last >= 0 {
+			if j, _ := d.Index(d.reverted[last].pos); j+1 > i {
+				i = j + 1
+			}
+		}
+		p, ok := d.GeneratePos(d.pairs[i-1].pos, d.pairs[i].pos)
+		if ok && d.insertLocal(p, e.atom) {
+			last = len(d.reverted) - 1
+			d.moved(e.pos, p)
+		}
+	}
+	return d.reverted
+}
+
+// moved makes the older edits of a character that was deleted and inserted again at p,
+// and the deletes next to it, refer to its new position.
+func (d *Document) moved(old, p []Identifier) {
+	for _, units := range [][][]edit{d.undo, d.redo, {d.pending}} {
+		for _, unit := range units {
+			for i := range unit {
+				if ComparePos(unit[i].pos, old) == 0 {
+					unit[i].pos = p
+				}
+				if unit[i].after != nil && ComparePos(unit[i].after, old) == 0 {
+					unit[i].after = p
+				}
+			}
+		}
+	}
+}
+
+// translateEdits moves the positions remembered for undo, and those of a revert under
+// way, into a new epoch.
+func (d *Document) translateEdits(l *layout) {
+	for _, units := range [][][]edit{d.undo, d.redo, {d.pending, d.reverted}} {
+		for _, unit := range units {
+			for i := range unit {
+				unit[i].pos = l.translate(unit[i].pos)
+				if unit[i].after != nil {
+					unit[i].after = l.translate(unit[i].after)
+				}
+			}
+		}
+	}
+}
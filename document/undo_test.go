@@ -0,0 +1,128 @@
+package document
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// pair of documents that start with the same content and know each other
+func undoPeers(content string) (*Document, *Document) {
+	doc1 := NewDocument(strings.Split(content, ""), 1)
+	doc2 := &Document{clientID: 2}
+	for _, e := range doc1.pairs {
+		doc2.insert(e.pos, e.atom)
+	}
+	doc1.ObserveVersion(2, nil)
+	doc2.ObserveVersion(1, nil)
+	return doc1, doc2
+}
+
+func exchange(docs ...*Document) {
+	for _, from := range docs {
+		for _, op := range from.TakeOps() {
+			for _, to := range docs {
+				if to != from {
+					to.Apply(op)
+				}
+			}
+		}
+	}
+}
+
+func TestUndoOnlyOwnEdits(t *testing.T) {
+	doc1, doc2 := undoPeers("ab")
+	doc1.InsertLeft(End, "1")
+	exchange(doc1, doc2)
+	doc2.InsertLeft(End, "2")
+	exchange(doc1, doc2)
+	assert.Equal(t, doc1.Content(), "ab12")
+
+	assert.Assert(t, doc1.Undo())
+	assert.Equal(t, doc1.Content(), "ab2")
+	assert.Assert(t, !doc1.Undo()) // the initial content and doc2's edit are not doc1's
+	exchange(doc1, doc2)
+	assert.Equal(t, doc2.Content(), "ab2")
+
+	// an insert a peer deleted since has nothing left to undo
+	doc1.InsertLeft(End, "3")
+	exchange(doc1, doc2)
+	doc2.DeleteLeft(End)
+	exchange(doc1, doc2)
+	assert.Assert(t, !doc1.Undo())
+	assert.Equal(t, doc1.Content(), "ab2")
+}
+
+func TestUndoUnits(t *testing.T) {
+	doc, _ := undoPeers("")
+	p, _ := doc.InsertLeft(End, "h")
+	p, _ = doc.InsertRight(p, "i")
+	doc.CloseUndoUnit()
+	p, _ = doc.InsertRight(p, "!")
+	doc.InsertRight(p, "!")
+	assert.Equal(t, doc.Content(), "hi!!")
+
+	assert.Assert(t, doc.Undo())
+	assert.Equal(t, doc.Content(), "hi")
+	assert.Assert(t, doc.Undo())
+	assert.Equal(t, doc.Content(), "")
+	assert.Assert(t, !doc.Undo())
+
+	assert.Assert(t, doc.Redo())
+	assert.Equal(t, doc.Content(), "hi")
+	assert.Assert(t, doc.Redo())
+	assert.Equal(t, doc.Content(), "hi!!")
+	assert.Assert(t, !doc.Redo())
+
+	// an edit after an undo starts a new unit and drops what could be redone
+	doc.Undo()
+	doc.InsertLeft(End, "?")
+	assert.Assert(t, !doc.Redo())
+	assert.Assert(t, doc.Undo())
+	assert.Equal(t, doc.Content(), "hi")
+
+	// edits of different kinds are undone separately
+	doc.DeleteLeft(End)
+	doc.InsertLeft(End, "o")
+	doc.Undo()
+	assert.Equal(t, doc.Content(), "h")
+}
+
+func TestUndoDeleteReinsertsInOrder(t *testing.T) {
+	doc1, doc2 := undoPeers("Entangle Text")
+	doc1.deleteMultiple(4, 10) // "angle "
+	assert.Equal(t, doc1.Content(), "EntText")
+	exchange(doc1, doc2)
+
+	// a peer types where the deleted text was
+	doc2.InsertLeft(doc2.pairs[4].pos, "_")
+	exchange(doc1, doc2)
+	assert.Equal(t, doc1.Content(), "Ent_Text")
+
+	// the text comes back in one piece, on either side of the peer's insert
+	assert.Assert(t, doc1.Undo())
+	content := doc1.Content()
+	assert.Assert(t, content == "Entangle _Text" || content == "Ent_angle Text", content)
+	exchange(doc1, doc2)
+	assert.Equal(t, doc2.Content(), doc1.Content())
+
+	assert.Assert(t, doc1.Redo())
+	assert.Equal(t, doc1.Content(), "Ent_Text")
+	exchange(doc1, doc2)
+	assert.Equal(t, doc2.Content(), doc1.Content())
+}
+
+func TestUndoAcrossRebalance(t *testing.T) {
+	doc, _ := undoPeers("")
+	p, _ := doc.InsertLeft(End, "a")
+	doc.InsertRight(p, "b")
+	doc.CloseUndoUnit()
+	doc.DeleteLeft(End)
+	assert.Assert(t, doc.Rebalance())
+
+	assert.Assert(t, doc.Undo())
+	assert.Equal(t, doc.Content(), "ab")
+	assert.Assert(t, doc.Undo())
+	assert.Equal(t, doc.Content(), "")
+}
@@ -0,0 +1,202 @@
+// Package editor is a full-screen terminal editor of the document of a node. Keys edit
+// the document left of a cursor that keeps its place while peers edit around it, and a
+// status bar tells who is in the session.
+package editor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/hesiyuan/EntangleText/node"
+)
+
+// Editor edits the document of a node. It only reads keys and writes screens, Run
+// connects it to a terminal.
+type Editor struct {
+	n      *node.Node
+	cursor node.Cursor
+	want   int    // column moving up and down aims for, -1 for the one of the cursor
+	top    int    // first line on the screen
+	left   int    // first column on the screen
+	msg    string // shown in the status bar until the next key
+
+	width, height int
+}
+
+// New returns an editor of the document of n, with the cursor at the start.
+func New(n *node.Node) *Editor {
+	return &Editor{n: n, cursor: n.CursorAt(0), want: -1, width: 80, height: 24}
+}
+
+// Resize sets the size of the screen.
+func (e *Editor) Resize(width, height int) {
+	if width > 0 && height > 1 {
+		e.width, e.height = width, height
+	}
+}
+
+// Key handles a key, and reports whether it quits the editor.
+func (e *Editor) Key(k rune) (quit bool) {
+	e.msg = ""
+	v := e.view()
+	want := -1
+	var err error
+	switch k {
+	case ctrlQ, ctrlC:
+		return true
+	case KeyLeft:
+		e.cursor = e.n.CursorAt(v.offset - 1)
+	case KeyRight:
+		e.cursor = e.n.CursorAt(v.offset + 1)
+	case KeyUp, KeyDown, KeyPageUp, KeyPageDown:
+		if want = e.want; want < 0 {
+			want = v.col
+		}
+		line := v.line + 1
+		switch k {
+		case KeyUp:
+			line = v.line - 1
+		case KeyPageUp:
+			line = v.line - e.rows() + 1
+		case KeyPageDown:
+			line = v.line + e.rows() - 1
+		}
+		if line < 0 {
+			line = 0
+		} else if line >= len(v.starts) {
+			line = len(v.starts) - 1
+		}
+		off := v.starts[line] + want
+		if end := v.end(line); off > end {
+			off = end
+		}
+		e.cursor = e.n.CursorAt(off)
+	case KeyHome, ctrlA:
+		e.cursor = e.n.CursorAt(v.starts[v.line])
+	case KeyEnd, ctrlE:
+		e.cursor = e.n.CursorAt(v.end(v.line))
+	case backspace, ctrlH:
+		e.cursor, err = e.n.DeleteBefore(e.cursor)
+	case KeyDelete, ctrlD:
+		if v.offset < len(v.text) {
+			_, err = e.n.DeleteBefore(e.n.CursorAt(v.offset + 1))
+		}
+	case enter:
+		e.cursor, err = e.n.InsertAt(e.cursor, "\n")
+	default:
+		if k == '\t' || k >= ' ' {
+			e.cursor, err = e.n.InsertAt(e.cursor, string(k))
+		}
+	}
+	e.want = want
+	if err != nil {
+		e.msg = err.Error()
+	}
+	return false
+}
+
+// Render writes the screen to w: the lines of the document around the cursor, then
+// the status bar.
+func (e *Editor) Render(w io.Writer) error {
+	v := e.view()
+	rows := e.rows()
+	if v.line < e.top {
+		e.top = v.line
+	} else if v.line >= e.top+rows {
+		e.top = v.line - rows + 1
+	}
+	if v.col < e.left {
+		e.left = v.col
+	} else if v.col >= e.left+e.width {
+		e.left = v.col - e.width + 1
+	}
+
+	var b bytes.Buffer
+	b.WriteString("\x1b[?25l\x1b[H") // hide the cursor while drawing
+	for r := 0; r < rows; r++ {
+		if line := e.top + r; line < len(v.starts) {
+			text := v.text[v.starts[line]:v.end(line)]
+			if len(text) > e.left {
+				text = text[e.left:]
+			} else {
+				text = nil
+			}
+			if len(text) > e.width {
+				text = text[:e.width]
+			}
+			for _, c := range text {
+				if c < ' ' || c == backspace {
+					c = ' '
+				}
+				b.WriteRune(c)
+			}
+		} else {
+			b.WriteByte('~')
+		}
+		b.WriteString("\x1b[K\r\n")
+	}
+	status := []rune(e.status(v))
+	if len(status) > e.width {
+		status = status[:e.width]
+	}
+	fmt.Fprintf(&b, "\x1b[7m%s%s\x1b[m", string(status), strings.Repeat(" ", e.width-len(status)))
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", v.line-e.top+1, v.col-e.left+1)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// status returns the text of the status bar.
+func (e *Editor) status(v view) string {
+	peers := "alone"
+	if addrs := e.n.Peers(); len(addrs) == 1 {
+		peers = "1 peer: " + addrs[0]
+	} else if len(addrs) > 1 {
+		peers = fmt.Sprintf("%d peers: %s", len(addrs), strings.Join(addrs, ", "))
+	}
+	msg := e.msg
+	if msg == "" {
+		msg = "Ctrl-Q quits"
+	}
+	return fmt.Sprintf(" %s (site %d) | %s | %d:%d | %s", e.n.Addr(), e.n.SiteID(), peers, v.line+1, v.col+1, msg)
+}
+
+// rows returns the number of lines of the document on the screen.
+func (e *Editor) rows() int {
+	return e.height - 1
+}
+
+// view is the document split in lines, and where the cursor is in it.
+type view struct {
+	text   []rune
+	starts []int // offset of every line
+	offset int   // of the cursor
+	line   int
+	col    int
+}
+
+// view returns the document as it is now.
+func (e *Editor) view() view {
+	v := view{text: []rune(e.n.Content()), starts: []int{0}}
+	for i, c := range v.text {
+		if c == '\n' {
+			v.starts = append(v.starts, i+1)
+		}
+	}
+	if v.offset = e.n.Offset(e.cursor); v.offset > len(v.text) {
+		v.offset = len(v.text) // edited in between
+	}
+	v.line = sort.Search(len(v.starts), func(i int) bool { return v.starts[i] > v.offset }) - 1
+	v.col = v.offset - v.starts[v.line]
+	return v
+}
+
+// end returns the offset of the end of a line, before its newline.
+func (v view) end(line int) int {
+	if line+1 < len(v.starts) {
+		return v.starts[line+1] - 1
+	}
+	return len(v.text)
+}
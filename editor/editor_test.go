@@ -0,0 +1,98 @@
+package editor
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/node"
+	"github.com/hesiyuan/EntangleText/transport"
+	"gotest.tools/assert"
+)
+
+// pair returns two nodes in a session on an in-memory network.
+func pair(t *testing.T) (*node.Node, *node.Node) {
+	net := transport.NewNetwork(1)
+	a, err := node.New(node.Config{Addr: "a", Peers: []string{"b"}, Transport: net.Node("a")})
+	assert.NilError(t, err)
+	b, err := node.New(node.Config{Addr: "b", Peers: []string{"a"}, Transport: net.Node("b")})
+	assert.NilError(t, err)
+	t.Cleanup(a.Stop)
+	t.Cleanup(b.Stop)
+	started := make(chan error)
+	go func() { started <- a.Start(context.Background()) }()
+	assert.NilError(t, b.Start(context.Background()))
+	assert.NilError(t, <-started)
+	return a, b
+}
+
+// typed sends keys to the editor.
+func typed(e *Editor, keys ...interface{}) {
+	for _, k := range keys {
+		switch k := k.(type) {
+		case string:
+			for _, r := range k {
+				e.Key(r)
+			}
+		case rune:
+			e.Key(k)
+		}
+	}
+}
+
+// screen renders the editor and returns the lines of the document on it.
+func screen(t *testing.T, e *Editor) []string {
+	var b bytes.Buffer
+	assert.NilError(t, e.Render(&b))
+	lines := strings.Split(b.String(), "\x1b[K\r\n")
+	lines[0] = strings.TrimPrefix(lines[0], "\x1b[?25l\x1b[H")
+	return lines[:len(lines)-1]
+}
+
+func TestEdit(t *testing.T) {
+	a, b := pair(t)
+	e := New(a)
+	typed(e, "hello", enter, "world", KeyUp, KeyEnd, "!", KeyDown, backspace, KeyHome, KeyDelete)
+	assert.Equal(t, a.Content(), "hello!\norl")
+	assert.Equal(t, a.Offset(e.cursor), 7)
+
+	// the column is kept across shorter lines
+	typed(e, KeyEnd, KeyUp, "?")
+	assert.Equal(t, a.Content(), "hel?lo!\norl")
+
+	// remote edits before the cursor move the text, not the cursor
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Content() != a.Content() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.NilError(t, b.Insert(0, ">> "))
+	for a.Content() != ">> hel?lo!\norl" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	typed(e, "_")
+	assert.Equal(t, a.Content(), ">> hel?_lo!\norl")
+}
+
+func TestRender(t *testing.T) {
+	a, _ := pair(t)
+	e := New(a)
+	e.Resize(10, 4)
+	typed(e, "one", enter, "two", enter, "three and more", enter, "four")
+	lines := screen(t, e)
+	assert.DeepEqual(t, lines[len(lines)-3:], []string{"two", "three and ", "four"}) // scrolled down
+
+	typed(e, KeyUp, KeyEnd)
+	lines = screen(t, e)
+	assert.Equal(t, lines[1], " and more") // scrolled right
+
+	var b bytes.Buffer
+	assert.NilError(t, e.Render(&b))
+	assert.Assert(t, strings.HasSuffix(b.String(), "\x1b[2;10H\x1b[?25h"))
+
+	e.Resize(80, 4)
+	b.Reset()
+	assert.NilError(t, e.Render(&b))
+	assert.Assert(t, strings.Contains(b.String(), " a (site 1) | 1 peer: b | 3:15 | Ctrl-Q quits"))
+}
@@ -0,0 +1,86 @@
+package editor
+
+// keys: what the terminal sends when keys are pressed
+
+import "unicode/utf8"
+
+// Keys that are not characters, as negative runes.
+const (
+	KeyUp rune = -(iota + 1)
+	KeyDown
+	KeyRight
+	KeyLeft
+	KeyHome
+	KeyEnd
+	KeyPageUp
+	KeyPageDown
+	KeyDelete
+)
+
+// Control keys, as the terminal sends them.
+const (
+	ctrlA     rune = 'A' - '@'
+	ctrlC     rune = 'C' - '@'
+	ctrlD     rune = 'D' - '@'
+	ctrlE     rune = 'E' - '@'
+	ctrlH     rune = 'H' - '@'
+	ctrlQ     rune = 'Q' - '@'
+	enter     rune = '\r'
+	backspace rune = 0x7f
+)
+
+const escape = 0x1b // starts the sequences of the other keys
+
+// escape sequences of the keys, by their last byte, after ESC [ or ESC O
+var finals = map[byte]rune{
+	'A': KeyUp, 'B': KeyDown, 'C': KeyRight, 'D': KeyLeft, 'H': KeyHome, 'F': KeyEnd,
+}
+
+// escape sequences ending in ~, by their parameter
+var tildes = map[string]rune{
+	"1": KeyHome, "7": KeyHome, "4": KeyEnd, "8": KeyEnd,
+	"3": KeyDelete, "5": KeyPageUp, "6": KeyPageDown,
+}
+
+// parseKeys returns the keys in the bytes a terminal sent, and the bytes of a
+// character cut short at the end, to parse again with the next ones. Escape sequences
+// that are unknown or cut short are dropped.
+func parseKeys(b []byte) (keys []rune, rest []byte) {
+	for len(b) > 0 {
+		if b[0] == escape {
+			var k rune
+			k, b = parseEscape(b)
+			if k != 0 {
+				keys = append(keys, k)
+			}
+			continue
+		}
+		if !utf8.FullRune(b) {
+			return keys, b
+		}
+		r, size := utf8.DecodeRune(b)
+		keys = append(keys, r)
+		b = b[size:]
+	}
+	return keys, nil
+}
+
+// parseEscape returns the key of the escape sequence b starts with, or 0, and the
+// bytes after it.
+func parseEscape(b []byte) (rune, []byte) {
+	if len(b) < 3 || b[1] != '[' && b[1] != 'O' {
+		if len(b) >= 2 {
+			return 0, b[2:] // ESC alone, or with Alt
+		}
+		return 0, nil
+	}
+	for i := 2; i < len(b); i++ {
+		if c := b[i]; c >= 0x40 && c <= 0x7e { // the last byte of the sequence
+			if c == '~' {
+				return tildes[string(b[2:i])], b[i+1:]
+			}
+			return finals[c], b[i+1:] // modifiers, as in ESC [ 1 ; 5 A, are ignored
+		}
+	}
+	return 0, nil
+}
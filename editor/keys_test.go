@@ -0,0 +1,24 @@
+package editor
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys, rest := parseKeys([]byte("a\x1b[A\x1bOB\x1b[3~\x1b[1;5C\x1b[99~é\r\x7f"))
+	assert.DeepEqual(t, keys, []rune{'a', KeyUp, KeyDown, KeyDelete, KeyRight, 'é', enter, backspace})
+	assert.Equal(t, len(rest), 0)
+
+	// a character cut short waits for the rest of it
+	keys, rest = parseKeys([]byte("x\xc3"))
+	assert.DeepEqual(t, keys, []rune{'x'})
+	assert.DeepEqual(t, rest, []byte("\xc3"))
+
+	// escape alone, with Alt and cut short
+	keys, _ = parseKeys([]byte("\x1bq\x1b"))
+	assert.Equal(t, len(keys), 0)
+	keys, _ = parseKeys([]byte("\x1b[5"))
+	assert.Equal(t, len(keys), 0)
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package editor
+
+import (
+	"os"
+	"syscall"
+)
+
+// signals of a terminal that changed size
+var resizeSignals = []os.Signal{syscall.SIGWINCH}
@@ -0,0 +1,6 @@
+package editor
+
+import "os"
+
+// Windows does not signal a terminal that changed size, the editor keeps its size.
+var resizeSignals []os.Signal
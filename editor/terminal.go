@@ -0,0 +1,112 @@
+package editor
+
+// running the editor in a terminal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/node"
+	"golang.org/x/term"
+)
+
+// how often the status bar is redrawn, for the peers that join and leave
+const statusEvery = time.Second
+
+// Run edits the document of n full screen in the terminal of in and out, until a key
+// quits the editor, ctx is done or the node stops. The document is redrawn on every
+// change peers make.
+func Run(ctx context.Context, n *node.Node, in, out *os.File) error {
+	fd := int(in.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("editor: not a terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+	out.WriteString("\x1b[?1049h") // the alternate screen, so the shell comes back as it was
+	defer out.WriteString("\x1b[?1049l")
+
+	e := New(n)
+	resize := func() {
+		if width, height, err := term.GetSize(int(out.Fd())); err == nil {
+			e.Resize(width, height)
+		}
+	}
+	resize()
+	resized := make(chan os.Signal, 1)
+	if len(resizeSignals) > 0 {
+		signal.Notify(resized, resizeSignals...)
+		defer signal.Stop(resized)
+	}
+
+	keys := make(chan []rune)
+	go readKeys(in, keys)
+	events := n.Events()
+	ticker := time.NewTicker(statusEvery)
+	defer ticker.Stop()
+	for {
+		if err := e.Render(out); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case ks, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			for _, k := range ks {
+				if e.Key(k) {
+					return nil
+				}
+			}
+		case _, ok := <-events:
+			if !ok {
+				return nil
+			}
+			drain(events)
+		case <-resized:
+			resize()
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain receives the changes that are already waiting, to redraw once for all of them.
+func drain(events <-chan node.Event) {
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// readKeys sends the keys read from in, until reading fails.
+func readKeys(in *os.File, keys chan<- []rune) {
+	defer close(keys)
+	buf := make([]byte, 256)
+	var rest []byte
+	for {
+		n, err := in.Read(buf[len(rest):])
+		if err != nil {
+			return
+		}
+		var ks []rune
+		ks, rest = parseKeys(buf[:len(rest)+n])
+		rest = append(buf[:0], rest...)
+		if len(ks) > 0 {
+			keys <- ks
+		}
+	}
+}
@@ -1,145 +1,156 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net"
-	"net/rpc"
 	"os"
-	"strconv"
-	"time"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hesiyuan/EntangleText/editor"
+	"github.com/hesiyuan/EntangleText/node"
 )
 
-// args in insert(args)
-type InsertArgs struct {
-	Char       uint8  // character to insert
-	Identifier uint8  // position identifier of the char TODO:
-	Clock      uint64 // value of logical clock at the issuing client
-	Clientid   uint8
-}
+const usage = `Usage: %[1]s <command> [options] [arguments]
+
+Commands:
+  serve              run a peer
+  join ip:port       run a peer that enters the session of the peer at ip:port
+  edit [ip:port]     run a peer and edit the document in the terminal, joining the
+                     session of the peer at ip:port if given
+  peers [ip:port]    list the members of the session of a running peer
+  cat [ip:port]      print the document of a peer from its data directory
+  dump [ip:port]     print the pairs of the document, with their positions
+  replay [ip:port]   rebuild the document from the write-ahead log
+  verify [ip:port]   check the write-ahead log and the snapshots
+  history [ip:port]  list the operations, or print the document as it was
+  blame [ip:port]    print who wrote every part of the document
+
+The ip:port of a peer may be left out when its data directory holds no other peer.
+Run %[1]s <command> -h for the options of a command.
+`
 
-// args in put(args)
-type DeleteArgs struct {
-	Char       uint8  // character to delete, could be omitted
-	Identifier uint8  // position identifier of the char to delete TODO:
-	Clock      uint64 // value of logical clock at the issuing client
-	Clientid   uint8
+// Entangle client main loop.
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "serve":
+		serveCommand(args)
+	case "join":
+		joinCommand(args)
+	case "edit":
+		editCommand(args)
+	case "peers":
+		peersCommand(args)
+	case "cat":
+		catCommand(args)
+	case "dump":
+		dumpCommand(args)
+	case "replay":
+		replayCommand(args)
+	case "verify":
+		verifyCommand(args)
+	case "history":
+		historyCommand(args)
+	case "blame":
+		blameCommand(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Printf(usage, os.Args[0])
+	default:
+		// flags or addresses: the client from before there were commands
+		if strings.HasPrefix(cmd, "-") || strings.Contains(cmd, ":") {
+			serveCommand(os.Args[1:])
+			return
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
 }
 
-// args in disconnect(args)
-type DisconnectArgs struct {
-	Clientid uint8 // client id who voluntarilly quit the editor
+// serveCommand runs a peer of the session of -peers.
+func serveCommand(args []string) {
+	serve("serve [options]", args, (*settings).positional, nil)
 }
 
-// Reply from service for all the API calls above.
-// This is actually not gonna be used.
-type ValReply struct {
-	Val string // value; depends on the call
+// joinCommand runs a peer that enters a running session through one of its peers, and
+// learns the others from it.
+func joinCommand(args []string) {
+	serve("join [options] ip:port", args, (*settings).join, nil)
 }
 
-type EntangleClient int
-
-// Command line arg.
-var numPeers uint8
-
-//a slice holding peer ip addresses
-var peerAddresses []string
-
-// a slice hoding rpc service of peers
-var peerServices []*rpc.Client
-
-// a insert char message from a peer
-func (ec *EntangleClient) Insert(args *InsertArgs, reply *ValReply) error {
-	// TODO
-
-	//testing
-	fmt.Printf(string(args.Char))
-	fmt.Println("remote insert")
-
-	return nil
-}
-
-// a delete char message from a peer
-func (ec *EntangleClient) Delete(args *DeleteArgs, reply *ValReply) error {
-	// TODO
-
-	return nil
-}
-
-// DISCONNECT from a peer.
-func (ec *EntangleClient) Disconnect(args *DisconnectArgs, reply *ValReply) error {
-	// TODO
-
-	return nil
+// editCommand runs a peer with the editor in front of it. Since the editor takes the
+// terminal, the log goes to a file next to the journal unless -log-file says otherwise.
+func editCommand(args []string) {
+	serve("edit [options] [ip:port]", args, func(s *settings, args []string) error {
+		if s.logFile == "" && !s.quiet {
+			s.logFile = filepath.Join(s.data, strings.TrimSuffix(node.DefaultJournal(s.listen), ".wal")+".log")
+		}
+		if len(args) == 0 {
+			return nil
+		}
+		return s.join(args)
+	}, func(ctx context.Context, n *node.Node) error {
+		return editor.Run(ctx, n, os.Stdin, os.Stdout)
+	})
 }
 
-// Entangle client main loop.
-func main() {
-	// Parse args.
-	usage := fmt.Sprintf("Usage: %s [ip:port] [N-clients] [ip1:port] ... [ipN:port]\n", os.Args[0])
-	if len(os.Args) < 4 {
-		fmt.Printf(usage)
-		os.Exit(1)
+// join reads the address of the peer to join the session of.
+func (s *settings) join(args []string) error {
+	if len(args) != 1 {
+		return errors.New("join: want the address of one peer of the session")
 	}
-
-	ip_port := os.Args[1]
-	arg, err := strconv.ParseUint(os.Args[2], 10, 8)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if s.transport == "rpc" {
+		return errors.New("join: peers on net/rpc cannot enter a running session, use -transport framed")
 	}
-	if arg == 0 {
-		fmt.Printf(usage)
-		fmt.Printf("\tnum-clients arg must be non-zero\n")
-		os.Exit(1)
+	journal := s.wal
+	if journal == "" {
+		journal = filepath.Join(s.data, node.DefaultJournal(s.listen))
 	}
-	numPeers = uint8(arg)
-
-	// Setup key-value store and register service.
-	entangleClient := new(EntangleClient)
-	rpc.Register(entangleClient)
+	if _, err := os.Stat(journal); s.site == 0 && err != nil {
+		return errors.New("join: -site is needed, one that no peer of the session uses")
+	}
+	s.peers = append(s.peers, args[0])
+	return nil
+}
 
-	// listen first
-	l, e := net.Listen("tcp", ip_port)
-	if e != nil {
-		log.Fatal("listen error:", e)
+// serve runs a peer until it is interrupted, then leaves the session cleanly. If front
+// is not nil, the peer runs until it returns.
+func serve(synopsis string, args []string, rest func(*settings, []string) error, front func(context.Context, *node.Node) error) {
+	s, err := loadSettings(synopsis, args, rest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	cfg, err := s.setup()
+	checkError(err)
 
-	// then dial
-	peerAddresses = make([]string, len(os.Args)-3)
-	peerServices := make([]*rpc.Client, len(os.Args)-3)
-	for i := range peerAddresses {
-		peerAddresses[i] = os.Args[i+3]
-		// Connect to other peers via RPC.
-		peerServices[i], err = rpc.Dial("tcp", peerAddresses[i])
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	n, err := node.New(cfg)
+	checkError(err)
+	control, err := serveControl(s.control, cfg.Addr, n)
+	if err != nil {
+		n.Stop() // closes the journal
 		checkError(err)
 	}
+	defer control.Close()
+	checkError(n.Start(ctx))
 
-	var kvVal ValReply
-	InsertArgs := InsertArgs{Char: 'c', Identifier: 12, Clientid: 1, Clock: 123}
-	ticker := time.NewTicker(time.Duration(2) * time.Second)
-	quit := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				fmt.Println("insert")
-				val := peerServices[0].Call("EntangleClient.Insert", InsertArgs, &kvVal)
-				fmt.Println(val)
-			case <-quit:
-				ticker.Stop()
-				close(quit)
-				fmt.Println("clock stopped")
-				return
-			}
-		}
-	}()
-
-	// TODO: Enter servicing loop, like:
-
-	for {
-		conn, _ := l.Accept()
-		go rpc.ServeConn(conn)
+	if front != nil {
+		err = front(ctx, n)
+	} else {
+		<-ctx.Done()
 	}
+	log.Println("leaving the session")
+	n.Stop() // waits for the node to stop, if the context already stopped it
+	checkError(err)
 }
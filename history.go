@@ -0,0 +1,86 @@
+package main
+
+// entangle history: what the document looked like before
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"github.com/hesiyuan/EntangleText/node"
+)
+
+// historyCommand lists the operations recorded in a journal, or prints the document at
+// one point of its history. It only reads the journal, so the client may be running.
+func historyCommand(args []string) {
+	fs, walPath := journalFlags("history", "Lists the operations of the history, or prints the document at one point of it.")
+	at := fs.Int("at", -1, "print the document after this many operations of the history")
+	when := fs.String("time", "", "print the document as it was at this time, in RFC 3339 format")
+	d := readJournal(fs, args, walPath)
+
+	switch {
+	case *when != "":
+		t, err := time.Parse(time.RFC3339, *when)
+		checkError(err)
+		fmt.Println(d.AtTime(t).Content())
+	case *at >= 0:
+		fmt.Println(d.AtIndex(*at).Content())
+	default:
+		for i, op := range d.History() {
+			fmt.Printf("%6d  %s  %3d:%-6d  %s\n", i+1, time.Unix(0, op.Time).Format(time.RFC3339), op.ID.Site, op.ID.Clock, describe(op))
+		}
+	}
+}
+
+// readJournal parses the arguments of a command that reads a journal and rebuilds the
+// document from it.
+func readJournal(fs *flag.FlagSet, args []string, walPath *string) *document.Document {
+	d, err := node.ReadJournal(journalPath(fs, args, walPath))
+	checkError(err)
+	return d
+}
+
+// journalPath parses the arguments of a command that reads a journal and returns the
+// journal: -wal, or the one of the peer at the ip:port argument in -data.
+func journalPath(fs *flag.FlagSet, args []string, walPath *string) string {
+	data := fs.String("data", ".", "directory of the journal")
+	fs.Parse(args)
+	if *walPath != "" {
+		return *walPath
+	}
+	return peerFile(fs, *data, node.DefaultJournal)
+}
+
+// peerFile returns the file of the peer at the ip:port argument in dir, named by name.
+// Without the argument, it returns the only file of a peer there.
+func peerFile(fs *flag.FlagSet, dir string, name func(addr string) string) string {
+	if fs.NArg() == 1 {
+		return filepath.Join(dir, name(fs.Arg(0)))
+	}
+	if fs.NArg() == 0 {
+		files, _ := filepath.Glob(filepath.Join(dir, name("*")))
+		if len(files) == 1 {
+			return files[0]
+		}
+		fmt.Fprintf(fs.Output(), "%d peers in %s, say which ip:port\n", len(files), dir)
+	}
+	fs.Usage()
+	os.Exit(1)
+	return ""
+}
+
+// describe returns a short description of an operation.
+func describe(op document.Op) string {
+	switch op.Kind {
+	case document.InsertOp:
+		return fmt.Sprintf("insert %q", op.Atom)
+	case document.DeleteOp:
+		return fmt.Sprintf("delete %d:%d", op.Target.Site, op.Target.Clock)
+	case document.RebalanceOp:
+		return fmt.Sprintf("rebalance %d positions", len(op.Positions))
+	}
+	return "unknown"
+}
@@ -0,0 +1,123 @@
+package main
+
+// entangle cat, dump, replay and verify: looking into the data directory of a peer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"github.com/hesiyuan/EntangleText/node"
+	"github.com/hesiyuan/EntangleText/wal"
+)
+
+// journalFlags returns the flag set of a command that reads a journal, and its -wal.
+func journalFlags(name, synopsis string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	walPath := fs.String("wal", "", "journal to read (default <data>/entangle-<ip:port>.wal)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [options] [ip:port]\n%s\n", os.Args[0], name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs, walPath
+}
+
+// catCommand prints the document recorded in a journal.
+func catCommand(args []string) {
+	fs, walPath := journalFlags("cat", "Prints the document.")
+	fmt.Println(readJournal(fs, args, walPath).Content())
+}
+
+// dumpCommand prints the pairs of the document recorded in a journal: position, the
+// operation that inserted the atom, and the atom.
+func dumpCommand(args []string) {
+	fs, walPath := journalFlags("dump", "Prints the pairs of the document, Start and End included.")
+	d := readJournal(fs, args, walPath)
+	fmt.Printf("site %d  epoch %d  version %s\n", d.SiteID(), d.Epoch(), version(d.Version()))
+	for i, e := range d.Entries() {
+		id := "-"
+		if e.ID != (document.OpID{}) {
+			id = fmt.Sprintf("%d:%d", e.ID.Site, e.ID.Clock)
+		}
+		fmt.Printf("%6d  %-30s  %-10s  %q\n", i, position(e.Pos), id, e.Atom)
+	}
+}
+
+// replayCommand rebuilds the document from a journal and tells what it holds.
+func replayCommand(args []string) {
+	fs, walPath := journalFlags("replay", "Rebuilds the document from the write-ahead log and describes it.")
+	snapshots := fs.Bool("snapshots", true, "start from the latest snapshot, false replays the write-ahead log alone")
+	out := fs.String("write", "", "write a snapshot of the rebuilt document to this file")
+	path := journalPath(fs, args, walPath)
+
+	read := node.ReadJournal
+	if !*snapshots {
+		read = node.ReadLog
+	}
+	d, err := read(path)
+	checkError(err)
+	fmt.Printf("site        %d\n", d.SiteID())
+	fmt.Printf("epoch       %d\n", d.Epoch())
+	fmt.Printf("version     %s\n", version(d.Version()))
+	fmt.Printf("history     %d operations\n", len(d.History()))
+	fmt.Printf("length      %d\n", len(d.Content()))
+	fmt.Printf("pairs       %d\n", len(d.Entries()))
+
+	if *out != "" {
+		data, err := d.MarshalBinary()
+		checkError(err)
+		checkError(wal.WriteSnapshot(*out, data))
+	}
+}
+
+// verifyCommand checks a journal and its snapshots, and exits with status 1 if
+// something is wrong with them.
+func verifyCommand(args []string) {
+	fs, walPath := journalFlags("verify", "Checks the write-ahead log and the snapshots, and exits with status 1 if they are damaged.")
+	path := journalPath(fs, args, walPath)
+
+	r, err := node.CheckJournal(path)
+	checkError(err)
+	fmt.Printf("%s: %d records, %d operations\n", path, r.Records, r.Ops)
+	if r.Torn > 0 {
+		fmt.Printf("%s: %d bytes of a torn last record, cut off when the peer starts\n", path, r.Torn)
+	}
+	if r.History > 0 {
+		fmt.Printf("%s.history.*: %d operations\n", path, r.History)
+	}
+	for _, s := range r.Snapshots {
+		fmt.Printf("%s: ok\n", s)
+	}
+	for _, p := range r.Problems {
+		fmt.Println("problem:", p)
+	}
+	if len(r.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// position returns a position identifier as ident:site pairs.
+func position(p []document.Identifier) string {
+	ids := make([]string, len(p))
+	for i, id := range p {
+		ids[i] = fmt.Sprintf("%d:%d", id.Ident, id.Site)
+	}
+	return strings.Join(ids, " ")
+}
+
+// version returns a version vector as site:clock pairs, by site.
+func version(vv document.VersionVector) string {
+	sites := make([]int, 0, len(vv))
+	for site := range vv {
+		sites = append(sites, int(site))
+	}
+	sort.Ints(sites)
+	clocks := make([]string, len(sites))
+	for i, site := range sites {
+		clocks[i] = fmt.Sprintf("%d:%d", site, vv[uint8(site)])
+	}
+	return strings.Join(clocks, " ")
+}
@@ -0,0 +1,102 @@
+package node
+
+// cursors: places in the document that stay put while peers edit around them
+
+import (
+	"errors"
+
+	"github.com/hesiyuan/EntangleText/document"
+)
+
+// Cursor is a place in the document between two characters. It holds the position of
+// the character right of it, End at the end of the document, so it keeps its place
+// whatever peers insert or delete elsewhere. A Cursor is a value, methods that move it
+// return the new one.
+type Cursor struct {
+	pos    []document.Identifier
+	epoch  uint32 // of pos
+	offset int    // where the cursor was, for when pos cannot be translated any more
+}
+
+// CursorAt returns a cursor before the character at offset, or at the end of the
+// document if offset is past it.
+func (n *Node) CursorAt(offset int) Cursor {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.cursorAt(offset)
+}
+
+// cursorAt returns a cursor before the character at offset. Callers hold mu.
+func (n *Node) cursorAt(offset int) Cursor {
+	if offset < 0 {
+		offset = 0
+	}
+	if l := n.length(); offset > l {
+		offset = l
+	}
+	p, _ := n.doc.Pos(offset + 1)
+	return Cursor{pos: p, epoch: n.doc.Epoch(), offset: offset}
+}
+
+// Offset returns the offset of the cursor in the document. A cursor whose character
+// was deleted is where the character was.
+func (n *Node) Offset(c Cursor) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.offset(c)
+}
+
+// offset returns the offset of the cursor. Callers hold mu.
+func (n *Node) offset(c Cursor) int {
+	if c.pos != nil {
+		if p, ok := n.doc.Translate(c.pos, c.epoch); ok {
+			i, _ := n.doc.Index(p) // Start is at 0, so the character right of the cursor is at i
+			return i - 1
+		}
+	}
+	if l := n.length(); c.offset > l {
+		return l
+	}
+	return c.offset
+}
+
+// InsertAt inserts text left of the cursor, which stays right of it, and returns the
+// cursor. Peers get it as one change.
+func (n *Node) InsertAt(c Cursor, text string) (Cursor, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isStopping() {
+		return c, ErrStopped
+	}
+	c = n.cursorAt(n.offset(c))
+	ok := true
+	n.doc.Begin()
+	for _, r := range text {
+		if _, ok = n.doc.InsertLeft(c.pos, string(r)); !ok {
+			break
+		}
+	}
+	n.doc.Commit()
+	if !ok {
+		return c, errors.New("node: no room left to insert")
+	}
+	err := n.takeOps()
+	return n.cursorAt(n.offset(c)), err // a rebalance may have moved it
+}
+
+// DeleteBefore deletes the character left of the cursor, if there is one, and returns
+// the cursor.
+func (n *Node) DeleteBefore(c Cursor) (Cursor, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isStopping() {
+		return c, ErrStopped
+	}
+	c = n.cursorAt(n.offset(c))
+	if c.offset == 0 {
+		return c, nil
+	}
+	n.doc.DeleteLeft(c.pos)
+	err := n.takeOps()
+	return n.cursorAt(n.offset(c)), err
+}
@@ -0,0 +1,40 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/hesiyuan/EntangleText/transport"
+	"gotest.tools/assert"
+)
+
+func TestCursor(t *testing.T) {
+	nodes := session(t, transport.NewNetwork(1), Config{}, "a", "b")
+	a, b := nodes[0], nodes[1]
+	assert.NilError(t, a.Insert(0, "Entangle"))
+	converged(t, "Entangle", a, b)
+
+	c := a.CursorAt(3) // Ent|angle
+	assert.NilError(t, b.Insert(0, "__"))
+	converged(t, "__Entangle", a)
+	assert.Equal(t, a.Offset(c), 5)
+
+	c, err := a.InsertAt(c, "xy")
+	assert.NilError(t, err)
+	assert.Equal(t, a.Offset(c), 7)
+	converged(t, "__Entxyangle", a, b)
+
+	// the character right of the cursor goes away, the cursor stays
+	assert.NilError(t, b.Delete(7, 1))
+	converged(t, "__Entxyngle", a)
+	assert.Equal(t, a.Offset(c), 7)
+	c, err = a.DeleteBefore(c)
+	assert.NilError(t, err)
+	assert.Equal(t, a.Offset(c), 6)
+	converged(t, "__Entxngle", a, b)
+
+	start := a.CursorAt(-1)
+	start, err = a.DeleteBefore(start)
+	assert.NilError(t, err)
+	assert.Equal(t, a.Offset(start), 0)
+	assert.Equal(t, a.Offset(a.CursorAt(100)), a.Len())
+}
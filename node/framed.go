@@ -0,0 +1,135 @@
+package node
+
+// the messages of peers speaking the framed protocol
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"github.com/hesiyuan/EntangleText/protocol"
+	"github.com/hesiyuan/EntangleText/transport"
+)
+
+// how often a peer tells it is still there, and which operations it has. A variable so
+// that tests need not wait.
+var heartbeatEvery = 5 * time.Second
+
+// receive handles the messages of a peer until the connection fails. A member whose
+// connection fails without a Disconnect is dropped and dialed again, since a peer that
+// crashed comes back at the same address and joins with a new connection.
+func (n *Node) receive(c transport.Conn) {
+	defer c.Close()
+	for {
+		m, err := c.Receive()
+		if err != nil {
+			if p := n.through(c); p != nil && !n.isStopping() {
+				log.Printf("connection to %s lost: %v", p.addr, err)
+				if n.drop(p) {
+					n.learn([]string{p.addr})
+				}
+			}
+			return
+		}
+		if err := n.handle(c, m); err != nil {
+			log.Printf("%v from %s failed: %v", m.Type, c.RemoteAddr(), err)
+		}
+	}
+}
+
+// through returns the member the node talks to through c, or nil.
+func (n *Node) through(c transport.Conn) *peer {
+	for _, p := range n.members() {
+		if p.conn == c {
+			return p
+		}
+	}
+	return nil
+}
+
+// taken returns the address of the member, or the node, other than addr that has
+// site, or "".
+func (n *Node) taken(site uint8, addr string) string {
+	if site == n.SiteID() {
+		return n.cfg.Addr
+	}
+	for _, p := range n.members() {
+		if p.site == site && p.addr != addr {
+			return p.addr
+		}
+	}
+	return ""
+}
+
+// handle handles a message of a peer.
+func (n *Node) handle(c transport.Conn, m protocol.Message) error {
+	switch m.Type {
+	case protocol.Insert, protocol.Delete:
+		m.Ops = []document.Op{m.Op}
+		fallthrough
+	case protocol.Batch:
+		return n.applyRemote(m.Ops)
+	case protocol.Sync:
+		n.observe(m.Site, m.Have)
+		n.mu.Lock()
+		ops, complete := n.doc.OpsSince(m.Have)
+		n.mu.Unlock()
+		if !complete {
+			return c.Send(protocol.Message{Type: protocol.Error, Text: "too far behind, a full copy of the document is needed"})
+		}
+		return c.Send(protocol.Message{Type: protocol.Batch, Ops: ops})
+	case protocol.Heartbeat:
+		if m.Have != nil {
+			n.observe(m.Site, m.Have)
+			if have, behind := n.behind(m.Have); behind {
+				// batches of the peer were lost on the way, ask again
+				return c.Send(protocol.Message{Type: protocol.Sync, Site: n.SiteID(), Have: have})
+			}
+		}
+	case protocol.Error:
+		log.Printf("%s reports: %s", c.RemoteAddr(), m.Text)
+	case protocol.Presence:
+		log.Printf("%s (site %d) is at %v", m.Name, m.Site, m.Cursor)
+	case protocol.Disconnect:
+		log.Printf("site %d left the session", m.Site)
+		n.leave(m.Site, "")
+	case protocol.Join:
+		if taken := n.taken(m.Site, m.Addr); taken != "" {
+			err := fmt.Errorf("site %d is taken by %s", m.Site, taken)
+			c.Send(protocol.Message{Type: protocol.Error, Text: err.Error()})
+			c.Close() // its operations would be mistaken for those of the other site
+			return err
+		}
+		if n.member(&peer{addr: m.Addr, site: m.Site, conn: c}) {
+			log.Printf("%s (site %d) joined", m.Addr, m.Site)
+		}
+		return c.Send(protocol.Message{Type: protocol.Members, Peers: append(n.Peers(), n.cfg.Addr)})
+	case protocol.Members:
+		n.learn(m.Peers)
+	}
+	return nil // messages of later versions
+}
+
+// behind returns the operations the node has, and reports whether a peer that has
+// those of have has some more.
+func (n *Node) behind(have document.VersionVector) (document.VersionVector, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	vv := n.doc.Version()
+	for site, clock := range have {
+		if clock > vv[site] {
+			return vv, true
+		}
+	}
+	return vv, false
+}
+
+// observe records the operations a peer has, and collects the tombstones every peer
+// has seen.
+func (n *Node) observe(site uint8, have document.VersionVector) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.doc.ObserveVersion(site, have)
+	n.doc.CollectGarbage()
+}
@@ -0,0 +1,442 @@
+package node
+
+// the write-ahead log of the document, so that a crash does not lose edits, and the
+// snapshots that keep it short. Snapshots leave out the history of the document, so the
+// operations they let the journal drop move to a history log next to it instead. The
+// history log is split in segments and only read when something needs the old history.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"github.com/hesiyuan/EntangleText/wal"
+)
+
+// Kinds of journal records. The journal starts with the site ID, then holds every
+// operation applied, local or remote, in the order it was applied: one per record, or
+// several applied together encoded with document.MarshalOps.
+const (
+	siteRecord byte = 'S'
+	opRecord   byte = 'O'
+	opsRecord  byte = 'B'
+)
+
+// historySegment is the size past which the history log goes on in a new segment, so
+// that opening it to append reads little.
+var historySegment int64 = 4 << 20
+
+// journal is the write-ahead log of a node and its snapshots.
+type journal struct {
+	log  *wal.Log
+	path string
+	sync bool
+
+	history    *wal.Log // last segment of the history log, nil until appended to
+	historySeq int      // number of the last segment, 0 for none
+	unloaded   bool     // the document's history lacks the operations of the history log
+
+	snapshotOps   int   // operations between two snapshots, 0 for none
+	snapshotSeq   int   // number of the last snapshot written
+	sinceSnapshot int   // operations journaled since the last snapshot
+	covered       int64 // journal offset up to which the last snapshot covers operations
+}
+
+// openJournal rebuilds the document from the latest valid snapshot and the journal at
+// path, then opens the journal for appending. A client that restarts from its journal
+// keeps the site ID it had, whatever clientID says, since its operations carry that ID.
+func openJournal(path string, sync bool, clientID uint8) (*journal, *document.Document, error) {
+	j := &journal{path: path, sync: sync}
+	d := j.loadSnapshot()
+	if segs := numbered(historyPrefix(path)); len(segs) > 0 {
+		j.historySeq = segs[len(segs)-1]
+	}
+	var past []document.Op
+	if d != nil {
+		clientID = d.SiteID()
+		j.unloaded = j.historySeq > 0
+	} else if j.historySeq > 0 { // the journal no longer has these operations
+		var err error
+		if past, err = readHistory(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	l, records, err := wal.Open(path, wal.Options{Sync: sync})
+	if err != nil {
+		return nil, nil, err
+	}
+	j.log = l
+	if len(records) == 0 {
+		site := []byte{siteRecord, clientID}
+		records = append(records, site)
+		if err := l.Append(site); err != nil {
+			j.close()
+			return nil, nil, err
+		}
+	}
+	j.covered = wal.RecordSize(records[0]) // the first snapshot keeps every operation
+	d, err = j.replay(d, past, records, clientID)
+	if err != nil {
+		j.close()
+		return nil, nil, err
+	}
+	return j, d, nil
+}
+
+// close closes the journal and the history log.
+func (j *journal) close() {
+	j.log.Close()
+	if j.history != nil {
+		j.history.Close()
+	}
+}
+
+// loadHistory gives d the operations of the history log, if it does not have them yet.
+func (j *journal) loadHistory(d *document.Document) error {
+	if !j.unloaded {
+		return nil
+	}
+	past, err := readHistory(j.path)
+	if err != nil {
+		return err
+	}
+	d.SetHistory(append(past, d.History()...))
+	j.unloaded = false
+	return nil
+}
+
+// ReadJournal rebuilds the document from the journal at path and its snapshots. It only
+// reads them, so the node writing them may be running.
+func ReadJournal(path string) (*document.Document, error) {
+	j := &journal{path: path}
+	records, err := wal.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	past, err := readHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	return j.replay(j.loadSnapshot(), past, records, 0)
+}
+
+// ReadLog rebuilds the document from the journal at path alone, without its snapshots.
+// The operations that a snapshot dropped from the journal are missing from it.
+func ReadLog(path string) (*document.Document, error) {
+	records, err := wal.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return (&journal{path: path}).replay(nil, nil, records, 0)
+}
+
+// DefaultJournal returns the journal of the node listening at addr.
+func DefaultJournal(addr string) string {
+	return "entangle-" + strings.Replace(addr, ":", "_", -1) + ".wal"
+}
+
+// historyPrefix returns the start of the names of the history segments of the journal
+// at path, which end with their number.
+func historyPrefix(path string) string {
+	return path + ".history."
+}
+
+// readHistory returns the operations of every segment of the history log of the journal
+// at path, oldest first.
+func readHistory(path string) ([]document.Op, error) {
+	var history []document.Op
+	for _, seq := range numbered(historyPrefix(path)) {
+		name := historyPrefix(path) + strconv.Itoa(seq)
+		records, err := wal.Read(name)
+		if err != nil {
+			return nil, err
+		}
+		for i, rec := range records {
+			ops, err := decode(rec)
+			if err != nil {
+				return nil, fmt.Errorf("%s: record %d: %v", name, i, err)
+			}
+			history = append(history, ops...)
+		}
+	}
+	return history, nil
+}
+
+// numbered returns the numbers of the files named prefix and a number, in order.
+func numbered(prefix string) []int {
+	names, _ := filepath.Glob(prefix + "*")
+	var seqs []int
+	for _, name := range names {
+		if seq, err := strconv.Atoi(strings.TrimPrefix(name, prefix)); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs
+}
+
+// replay applies the operations of the journal records to d, the document of the
+// latest snapshot or nil if there is none, and gives it back its history: the
+// operations of past, from the history log, then those of the journal. Without a
+// snapshot, past is applied first, as the journal no longer has it.
+func (j *journal) replay(d *document.Document, past []document.Op, records [][]byte, clientID uint8) (*document.Document, error) {
+	path := j.path
+	if len(records) == 0 || len(records[0]) != 2 || records[0][0] != siteRecord {
+		return nil, fmt.Errorf("%s: no site ID at the start of the journal", path)
+	}
+	if id := records[0][1]; id != clientID && clientID != 0 {
+		log.Printf("%s: keeping site ID %d from the journal instead of %d", path, id, clientID)
+	}
+	clientID = records[0][1]
+	history := past
+	fresh := d == nil
+	if fresh {
+		d = document.NewDocument(nil, clientID)
+	}
+	d.SetRebalanceDepth(0) // replay the rebalances that happened, no others
+	if fresh {
+		for _, op := range history {
+			d.Apply(op)
+		}
+	}
+	n := 0
+	for i, rec := range records[1:] {
+		ops, err := decode(rec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: record %d: %v", path, i+1, err)
+		}
+		for _, op := range ops {
+			d.Apply(op) // operations the snapshot already has are ignored
+		}
+		history = append(history, ops...)
+		n += len(ops)
+	}
+	d.SetRebalanceDepth(document.DefaultRebalanceDepth)
+	d.SetHistory(history)
+	log.Printf("%s: replayed %d operations", path, n)
+	return d, nil
+}
+
+// decode returns the operations of a journal record other than the first.
+func decode(rec []byte) ([]document.Op, error) {
+	switch {
+	case len(rec) > 0 && rec[0] == opRecord:
+		ops := make([]document.Op, 1)
+		return ops, ops[0].UnmarshalBinary(rec[1:])
+	case len(rec) > 0 && rec[0] == opsRecord:
+		return document.UnmarshalOps(rec[1:])
+	}
+	return nil, errors.New("unknown record")
+}
+
+// append writes operations to the journal in one record.
+func (j *journal) append(ops ...document.Op) error {
+	var rec []byte
+	var err error
+	switch len(ops) {
+	case 0:
+		return nil
+	case 1:
+		rec, err = ops[0].MarshalBinary()
+		rec = append([]byte{opRecord}, rec...)
+	default:
+		rec, err = document.MarshalOps(ops)
+		rec = append([]byte{opsRecord}, rec...)
+	}
+	if err != nil {
+		return err
+	}
+	if err := j.log.Append(rec); err != nil {
+		return err
+	}
+	j.sinceSnapshot += len(ops)
+	return nil
+}
+
+// snapshotDue takes a snapshot of d if snapshotOps operations were journaled since the
+// last one. d must have applied them.
+func (j *journal) snapshotDue(d *document.Document) {
+	if j.snapshotOps > 0 && j.sinceSnapshot >= j.snapshotOps {
+		j.snapshot(d)
+	}
+}
+
+// snapshot writes the state of the document and moves the operations the previous
+// snapshot covers from the journal to the history log. The ones after it are kept so
+// that a damaged last snapshot can be recovered from the previous one.
+func (j *journal) snapshot(d *document.Document) {
+	data, err := d.MarshalBinary()
+	if err == nil {
+		err = wal.WriteSnapshot(j.snapshotName(j.snapshotSeq+1), data)
+	}
+	if err != nil {
+		log.Println("snapshot failed:", err)
+		return
+	}
+	j.snapshotSeq++
+	j.sinceSnapshot = 0
+	os.Remove(j.snapshotName(j.snapshotSeq - 2))
+
+	// keep the operations about to be dropped, as the snapshot has no history
+	records, err := wal.Read(j.path)
+	if err != nil {
+		log.Println("reading the journal failed:", err)
+		return
+	}
+	end := wal.RecordSize(records[0])
+	for _, rec := range records[1:] {
+		if end += wal.RecordSize(rec); end > j.covered {
+			break
+		}
+		if err := j.appendHistory(rec); err != nil {
+			log.Println("writing the history failed:", err)
+			return
+		}
+	}
+
+	end = j.log.Size()
+	start, err := j.log.Compact([][]byte{{siteRecord, d.SiteID()}}, j.covered)
+	if err != nil {
+		log.Println("compacting the journal failed:", err)
+		return
+	}
+	j.covered = start + end - j.covered
+}
+
+// appendHistory appends a record to the last segment of the history log, or to a new
+// one if it is full.
+func (j *journal) appendHistory(rec []byte) error {
+	if j.history != nil && j.history.Size() >= historySegment {
+		j.history.Close()
+		j.history = nil
+		j.historySeq++
+	}
+	if j.history == nil {
+		if j.historySeq == 0 {
+			j.historySeq = 1
+		}
+		h, _, err := wal.Open(historyPrefix(j.path)+strconv.Itoa(j.historySeq), wal.Options{Sync: j.sync})
+		if err != nil {
+			return err
+		}
+		j.history = h
+	}
+	return j.history.Append(rec)
+}
+
+// snapshotName returns the file of the seq-th snapshot.
+func (j *journal) snapshotName(seq int) string {
+	return fmt.Sprintf("%s.snap.%d", j.path, seq)
+}
+
+// loadSnapshot returns the document of the latest snapshot that can be read, or nil if
+// there is none.
+func (j *journal) loadSnapshot() *document.Document {
+	seqs := j.snapshots()
+	if len(seqs) > 0 {
+		j.snapshotSeq = seqs[0]
+	}
+	for _, seq := range seqs {
+		d, err := readSnapshot(j.snapshotName(seq))
+		if err == nil {
+			log.Printf("%s: loaded", j.snapshotName(seq))
+			return d
+		}
+		log.Printf("%s: skipped: %v", j.snapshotName(seq), err)
+	}
+	return nil
+}
+
+// snapshots returns the numbers of the snapshots on disk, latest first.
+func (j *journal) snapshots() []int {
+	seqs := numbered(j.path + ".snap.")
+	sort.Sort(sort.Reverse(sort.IntSlice(seqs)))
+	return seqs
+}
+
+// readSnapshot returns the document of the snapshot at path.
+func readSnapshot(path string) (*document.Document, error) {
+	data, err := wal.ReadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	d := new(document.Document)
+	return d, d.UnmarshalBinary(data)
+}
+
+// JournalReport is what CheckJournal found in a journal and its snapshots.
+type JournalReport struct {
+	Records   int      // good records, the site ID included
+	Ops       int      // operations they hold
+	History   int      // operations in the history log
+	Torn      int64    // bytes of a damaged last record, cut off when the node opens the journal
+	Snapshots []string // snapshots that can be loaded, latest first
+	Problems  []string // everything that is wrong
+}
+
+// CheckJournal checks every record of the journal at path and every snapshot of it,
+// without changing them. The error is only for a journal that cannot be read at all.
+func CheckJournal(path string) (JournalReport, error) {
+	var r JournalReport
+	w, err := wal.Check(path)
+	if errors.Is(err, wal.ErrCorrupt) {
+		r.Problems = append(r.Problems, err.Error())
+	} else if err != nil {
+		return r, err
+	}
+	r.Records, r.Torn = w.Records, w.Torn
+
+	if err == nil {
+		records, err := wal.Read(path)
+		if err != nil {
+			return r, err
+		}
+		if len(records) == 0 || len(records[0]) != 2 || records[0][0] != siteRecord {
+			r.Problems = append(r.Problems, "no site ID at the start of the journal")
+		}
+		for i, rec := range records {
+			if i == 0 {
+				continue
+			}
+			ops, err := decode(rec)
+			if err != nil {
+				r.Problems = append(r.Problems, fmt.Sprintf("record %d: %v", i, err))
+			}
+			r.Ops += len(ops)
+		}
+	}
+
+	for _, seq := range numbered(historyPrefix(path)) {
+		name := historyPrefix(path) + strconv.Itoa(seq)
+		past, err := wal.Read(name)
+		if err != nil {
+			r.Problems = append(r.Problems, err.Error())
+			continue
+		}
+		for i, rec := range past {
+			ops, err := decode(rec)
+			if err != nil {
+				r.Problems = append(r.Problems, fmt.Sprintf("%s: record %d: %v", name, i, err))
+			}
+			r.History += len(ops)
+		}
+	}
+
+	j := &journal{path: path}
+	for _, seq := range j.snapshots() {
+		name := j.snapshotName(seq)
+		if _, err := readSnapshot(name); err != nil {
+			r.Problems = append(r.Problems, fmt.Sprintf("%s: %v", name, err))
+		} else {
+			r.Snapshots = append(r.Snapshots, name)
+		}
+	}
+	return r, nil
+}
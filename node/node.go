@@ -0,0 +1,748 @@
+// Package node runs a peer of an EntangleText session: it holds the replicated
+// document, its journal and the connections to the other peers, so that any program can
+// take part in a session.
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"github.com/hesiyuan/EntangleText/protocol"
+	"github.com/hesiyuan/EntangleText/transport"
+)
+
+// Config describes a node.
+type Config struct {
+	Addr  string   // address the node listens at
+	Peers []string // addresses of the other peers of the session
+
+	// Site is the site ID of the node. If it is 0, the peers are numbered by the order
+	// of their addresses, so every peer of the session gets a different one as long as
+	// Peers lists all of them. A node joining a running session needs a site ID no
+	// member uses. A node restarting from its journal keeps the site ID it had.
+	Site uint8
+
+	// Transport connects the node to its peers. If it is nil, it is TCP, secured with
+	// TLS if not nil, and the peers that only speak net/rpc are served on the same port.
+	Transport transport.Transport
+	TLS       *tls.Config
+
+	// Journal is the write-ahead log of the document. If it is empty, the document only
+	// lives in memory.
+	Journal       string
+	Sync          bool          // sync the journal to disk before acknowledging operations
+	SnapshotOps   int           // operations between two snapshots, 0 for none
+	SnapshotEvery time.Duration // time between two snapshots, 0 for none
+
+	BatchOps   int           // most operations sent to a peer at once, 256 if 0
+	BatchDelay time.Duration // time operations wait for others to be sent with
+
+	// Timeout is how long a call to a peer may take, and how long Stop waits for the
+	// queued operations to be sent. It is 10 seconds if 0.
+	Timeout time.Duration
+
+	// LegacyRPC sends operations to peers with net/rpc, for peers that do not speak the
+	// framed protocol.
+	LegacyRPC bool
+	// AntiEntropy is how often the document is compared with the ones of the peers, 0
+	// for never. Like LegacyRPC, it uses net/rpc, which needs a transport that is a
+	// transport.LegacyDialer.
+	AntiEntropy time.Duration
+}
+
+// ErrStopped is returned when editing the document of a node that is stopping.
+var ErrStopped = errors.New("node: stopped")
+
+// Event is a change of the document.
+type Event struct {
+	Ops   []document.Op // the operations of the change, several for a group
+	Local bool          // made by this node
+}
+
+// Node is a peer of a session. Its methods may be called from several goroutines.
+type Node struct {
+	cfg Config
+	tr  transport.Transport
+	srv *rpc.Server
+
+	mu      sync.Mutex // guards doc and journal
+	doc     *document.Document
+	journal *journal // nil when the document lives in memory
+
+	listener transport.Listener
+	peers    []*peer          // members of the session, in the order they joined
+	accepted []transport.Conn // connections peers opened
+	dialing  map[string]bool  // members being dialed, see learn
+
+	events  chan Event
+	evMu    sync.Mutex
+	evQueue []Event
+	evWake  chan struct{}
+
+	ctx      context.Context // done once the node stopped, bounds calls to peers
+	cancel   context.CancelFunc
+	stopping chan struct{} // closed when Stop starts
+	stopped  sync.Once
+}
+
+// peer is another member of the session: how to reach it and what is queued for it.
+// Members either are configured, or join by dialing the node and sending a Join
+// message, which the node answers with the members it knows. A node that joins dials
+// those in turn.
+type peer struct {
+	addr   string
+	site   uint8          // 0 until it sends a Join
+	rpc    *rpc.Client    // nil unless net/rpc is used
+	conn   transport.Conn // nil with LegacyRPC
+	sender *sender
+}
+
+// how long peers that are not listening yet are waited for
+const dialPatience = 10 * time.Second
+
+// New opens the journal of a node and rebuilds its document from it. The node does not
+// talk to anyone before Start.
+func New(cfg Config) (*Node, error) {
+	if cfg.BatchOps == 0 {
+		cfg.BatchOps = 256
+	}
+	if cfg.BatchOps < 0 {
+		return nil, errors.New("node: negative batch size")
+	}
+	if cfg.Site == 0 {
+		cfg.Site = siteID(cfg.Addr, cfg.Peers)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if _, ok := cfg.Transport.(transport.LegacyDialer); cfg.Transport != nil && !ok && (cfg.LegacyRPC || cfg.AntiEntropy > 0) {
+		return nil, errors.New("node: net/rpc cannot go through the transport")
+	}
+	n := &Node{cfg: cfg, stopping: make(chan struct{}), dialing: make(map[string]bool)}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	if cfg.Journal == "" {
+		n.doc = document.NewDocument(nil, cfg.Site)
+	} else {
+		j, doc, err := openJournal(cfg.Journal, cfg.Sync, cfg.Site)
+		if err != nil {
+			return nil, err
+		}
+		j.snapshotOps = cfg.SnapshotOps
+		n.journal, n.doc = j, doc
+	}
+	n.doc.Watch(n.changed)
+
+	n.srv = rpc.NewServer()
+	if err := n.srv.RegisterName("EntangleClient", &service{n}); err != nil {
+		return nil, err
+	}
+	n.tr = cfg.Transport
+	if n.tr == nil {
+		n.tr = &transport.TCP{Site: n.doc.SiteID(), Legacy: func(c net.Conn) { n.srv.ServeConn(c) }, Timeout: cfg.Timeout, TLS: cfg.TLS}
+	}
+	return n, nil
+}
+
+// Start listens, connects to the peers and catches up with the edits made while the
+// node was away. Peers that are not listening yet are waited for a while, unless ctx is
+// done first. Once ctx is done, the node stops.
+func (n *Node) Start(ctx context.Context) error {
+	// listen first, and serve peers before dialing them since the framed handshake
+	// needs an answer
+	l, err := n.tr.Listen(n.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	n.listener = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err == transport.ErrClosed {
+				return
+			}
+			if err != nil {
+				log.Printf("accepting a peer failed: %v", err)
+				continue
+			}
+			n.mu.Lock()
+			n.accepted = append(n.accepted, conn)
+			n.mu.Unlock()
+			go n.receive(conn)
+		}
+	}()
+
+	// then dial
+	for _, addr := range n.cfg.Peers {
+		p, err := n.dial(ctx, addr)
+		if err != nil {
+			n.Stop()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("dialing %s: %v", addr, err)
+		}
+		n.add(p)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.Stop()
+		case <-n.ctx.Done():
+		}
+	}()
+
+	// catch up in the background, since peers doing the same need us to serve them
+	go func() {
+		for _, p := range n.members() {
+			if err := n.syncWith(p); err != nil {
+				log.Printf("sync with %s failed: %v", p.addr, err)
+			}
+		}
+	}()
+	if n.journal != nil && n.cfg.SnapshotEvery > 0 {
+		go n.every(n.cfg.SnapshotEvery, func() {
+			n.mu.Lock()
+			if n.journal != nil && n.journal.sinceSnapshot > 0 {
+				n.journal.snapshot(n.doc)
+			}
+			n.mu.Unlock()
+		})
+	}
+	if n.cfg.AntiEntropy > 0 {
+		go n.every(n.cfg.AntiEntropy, func() {
+			for _, p := range n.members() {
+				if p.rpc == nil {
+					continue // joined us, and did not tell how to reach its net/rpc
+				}
+				if err := n.antiEntropy(p); err != nil {
+					log.Printf("anti-entropy with %s failed: %v", p.addr, err)
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// dial connects to the peer at addr, over net/rpc, the framed protocol or both, as
+// configured.
+func (n *Node) dial(ctx context.Context, addr string) (*peer, error) {
+	p := &peer{addr: addr}
+	var err error
+	if n.cfg.LegacyRPC || n.cfg.AntiEntropy > 0 {
+		err = retry(ctx, func() error {
+			c, err := n.tr.(transport.LegacyDialer).DialLegacy(addr)
+			if err == nil {
+				p.rpc = rpc.NewClient(c)
+			}
+			return err
+		})
+	}
+	if err == nil && !n.cfg.LegacyRPC {
+		err = retry(ctx, func() (err error) {
+			p.conn, err = n.tr.Dial(addr)
+			return err
+		})
+	}
+	if err != nil && p.rpc != nil {
+		p.rpc.Close()
+	}
+	return p, err
+}
+
+// add makes a peer the node dialed a member, and announces the node to it. If there
+// already is a member at its address, which happens when both dialed each other at once,
+// the new connections are closed.
+func (n *Node) add(p *peer) bool {
+	if !n.member(p) {
+		p.close()
+		return false
+	}
+	if p.conn != nil {
+		go n.receive(p.conn)
+		if err := p.conn.Send(protocol.Message{Type: protocol.Join, Site: n.SiteID(), Addr: n.cfg.Addr}); err != nil {
+			log.Printf("joining %s failed: %v", p.addr, err)
+		}
+	}
+	return true
+}
+
+// member makes p a member and starts sending it operations, unless there already is a
+// member at its address or the node is stopping.
+func (n *Node) member(p *peer) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isStopping() || p.addr == n.cfg.Addr {
+		return false
+	}
+	for _, q := range n.peers {
+		if q.addr == p.addr {
+			if p.site != 0 {
+				q.site = p.site
+			}
+			return false
+		}
+	}
+	p.sender = n.newSender(p)
+	n.peers = append(n.peers, p)
+	return true
+}
+
+// leave removes the member at addr that left the session, or if addr is empty the
+// member of site. Members that only speak net/rpc never told their site.
+func (n *Node) leave(site uint8, addr string) {
+	for _, p := range n.members() {
+		if addr != "" && p.addr == addr || addr == "" && p.site == site {
+			n.drop(p)
+			return
+		}
+	}
+}
+
+// drop removes a member and closes the connections to it, and reports whether it still
+// was a member.
+func (n *Node) drop(p *peer) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, q := range n.peers {
+		if q == p {
+			n.peers = append(n.peers[:i:i], n.peers[i+1:]...)
+			close(p.sender.gone)
+			p.close()
+			return true
+		}
+	}
+	return false
+}
+
+// join dials a member the node learned about, and catches up with it.
+func (n *Node) join(addr string) {
+	defer func() {
+		n.mu.Lock()
+		delete(n.dialing, addr)
+		n.mu.Unlock()
+	}()
+	p, err := n.dial(n.ctx, addr)
+	if err != nil {
+		log.Printf("dialing %s failed: %v", addr, err)
+		return
+	}
+	if n.add(p) {
+		log.Printf("joined %s", addr)
+		if err := n.syncWith(p); err != nil {
+			log.Printf("sync with %s failed: %v", addr, err)
+		}
+	}
+}
+
+// learn dials the members the node does not know yet.
+func (n *Node) learn(addrs []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	known := map[string]bool{n.cfg.Addr: true}
+	for _, p := range n.peers {
+		known[p.addr] = true
+	}
+	for _, addr := range addrs {
+		if !known[addr] && !n.dialing[addr] && !n.isStopping() {
+			n.dialing[addr] = true
+			go n.join(addr)
+		}
+	}
+}
+
+// members returns the peers that are members of the session.
+func (n *Node) members() []*peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*peer(nil), n.peers...)
+}
+
+// close closes the connections to a peer.
+func (p *peer) close() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	if p.rpc != nil {
+		p.rpc.Close()
+	}
+}
+
+// Stop leaves the session: it sends the operations queued for the peers, waiting for
+// them Timeout at most, tells the peers it is leaving, then closes the connections, the
+// journal and the Events channel. The document can still be read after.
+func (n *Node) Stop() {
+	n.stopped.Do(func() {
+		n.mu.Lock()
+		close(n.stopping) // no more local edits to queue
+		peers := n.peers
+		n.mu.Unlock()
+		if n.listener != nil {
+			n.listener.Close()
+		}
+
+		timeout := time.After(n.cfg.Timeout)
+		for _, p := range peers {
+			select {
+			case <-p.sender.finished:
+			case <-timeout:
+				log.Printf("operations left unsent to %s", p.addr)
+			}
+		}
+		for _, p := range peers {
+			if err := n.disconnect(p); err != nil {
+				log.Printf("leaving %s failed: %v", p.addr, err)
+			}
+		}
+		n.cancel()
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for _, p := range peers {
+			p.close()
+		}
+		for _, c := range n.accepted {
+			c.Close()
+		}
+		if n.journal != nil {
+			n.journal.close()
+			n.journal = nil
+		}
+	})
+}
+
+// disconnect tells a peer the node is leaving.
+func (n *Node) disconnect(p *peer) error {
+	if p.conn != nil {
+		return p.conn.Send(protocol.Message{Type: protocol.Disconnect, Site: n.SiteID()})
+	}
+	return n.call(p, "EntangleClient.Disconnect", &DisconnectArgs{Clientid: n.SiteID(), Addr: n.cfg.Addr}, new(ValReply))
+}
+
+// call calls a method of the net/rpc service of a peer, giving up after Timeout or once
+// the node stopped.
+func (n *Node) call(p *peer, method string, args, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(n.ctx, n.cfg.Timeout)
+	defer cancel()
+	c := p.rpc.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		return c.Error
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+}
+
+// every calls f every period until the node stops.
+func (n *Node) every(period time.Duration, f func()) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			f()
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// Insert inserts text before the character at offset, counting from 0, or at the end
+// if offset is the length of the document. Peers get it as one change.
+func (n *Node) Insert(offset int, text string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isStopping() {
+		return ErrStopped
+	}
+	if offset < 0 || offset > n.length() {
+		return fmt.Errorf("node: offset %d out of the document", offset)
+	}
+	p, _ := n.doc.Pos(offset) // the character before offset
+	return n.insert(p, text)
+}
+
+// Append inserts text at the end of the document, whatever peers do meanwhile.
+func (n *Node) Append(text string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isStopping() {
+		return ErrStopped
+	}
+	p, _ := n.doc.Left(document.End)
+	return n.insert(p, text)
+}
+
+// insert inserts text right of p. Callers hold mu.
+func (n *Node) insert(p []document.Identifier, text string) error {
+	ok := true
+	n.doc.Begin()
+	for _, c := range text {
+		if p, ok = n.doc.InsertRight(p, string(c)); !ok {
+			break
+		}
+	}
+	n.doc.Commit()
+	if !ok {
+		return errors.New("node: no room left to insert")
+	}
+	return n.takeOps()
+}
+
+// Delete deletes count characters from offset on. Peers get it as one change.
+func (n *Node) Delete(offset, count int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isStopping() {
+		return ErrStopped
+	}
+	if offset < 0 || count < 0 || offset+count > n.length() {
+		return fmt.Errorf("node: %d characters from offset %d out of the document", count, offset)
+	}
+	p, _ := n.doc.Pos(offset)
+	n.doc.Begin()
+	for i := 0; i < count; i++ {
+		n.doc.DeleteRight(p)
+	}
+	n.doc.Commit()
+	return n.takeOps()
+}
+
+// Undo undoes the last local edit still visible, and reports whether there was one.
+// Peers get the undo like any other edit.
+func (n *Node) Undo() (bool, error) {
+	return n.undo(n.doc.Undo)
+}
+
+// Redo undoes the last Undo, if no local edit happened since, and reports whether there
+// was one.
+func (n *Node) Redo() (bool, error) {
+	return n.undo(n.doc.Redo)
+}
+
+// undo calls Undo or Redo of the document and sends what it did.
+func (n *Node) undo(f func() bool) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isStopping() {
+		return false, ErrStopped
+	}
+	if !f() {
+		return false, nil
+	}
+	return true, n.takeOps()
+}
+
+// Revert undoes operations of any site, by their IDs as in the Ops of events.
+func (n *Node) Revert(ids ...document.OpID) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isStopping() {
+		return ErrStopped
+	}
+	for _, id := range ids {
+		if _, ok := n.doc.HistoryOp(id); !ok && n.journal != nil {
+			if err := n.journal.loadHistory(n.doc); err != nil { // older than the snapshot
+				return err
+			}
+			break
+		}
+	}
+	if err := n.doc.Revert(ids...); err != nil {
+		return err
+	}
+	return n.takeOps()
+}
+
+// isStopping reports whether Stop started.
+func (n *Node) isStopping() bool {
+	select {
+	case <-n.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Content returns the text of the document.
+func (n *Node) Content() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.doc.Content()
+}
+
+// Len returns the number of characters of the document.
+func (n *Node) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.length()
+}
+
+// length returns the number of characters of the document. Callers hold mu.
+func (n *Node) length() int {
+	i, _ := n.doc.Index(document.End)
+	return i - 1
+}
+
+// SiteID returns the site ID of the node.
+func (n *Node) SiteID() uint8 {
+	return n.doc.SiteID()
+}
+
+// Addr returns the address the node listens at.
+func (n *Node) Addr() string {
+	return n.cfg.Addr
+}
+
+// Peers returns the addresses of the other members of the session, in order.
+func (n *Node) Peers() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addrs := make([]string, len(n.peers))
+	for i, p := range n.peers {
+		addrs[i] = p.addr
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Events returns a channel that receives every change of the document, local or
+// remote, in the order they were applied, until the node stops. Changes are only kept
+// for it once Events has been called, and they are kept until received.
+func (n *Node) Events() <-chan Event {
+	n.evMu.Lock()
+	defer n.evMu.Unlock()
+	if n.events == nil {
+		n.events = make(chan Event)
+		n.evWake = make(chan struct{}, 1)
+		go n.deliver()
+	}
+	return n.events
+}
+
+// changed queues a change of the document for Events.
+func (n *Node) changed(ops []document.Op) {
+	n.evMu.Lock()
+	defer n.evMu.Unlock()
+	if n.events == nil {
+		return
+	}
+	n.evQueue = append(n.evQueue, Event{Ops: ops, Local: ops[0].ID.Site == n.doc.SiteID()})
+	select {
+	case n.evWake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the queued changes to the Events channel, so that a slow receiver does
+// not hold up the document.
+func (n *Node) deliver() {
+	defer close(n.events)
+	for {
+		n.evMu.Lock()
+		queue := n.evQueue
+		n.evQueue = nil
+		n.evMu.Unlock()
+		for _, e := range queue {
+			select {
+			case n.events <- e:
+			case <-n.ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-n.evWake:
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// applyRemote journals the operations from peers the document does not have yet, then
+// applies them. If the journal fails, none is applied and the peer sends them again, so
+// the document never has an operation a restart would lose.
+func (n *Node) applyRemote(ops []document.Op) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var fresh []document.Op
+	seen := make(map[document.OpID]bool)
+	for _, op := range ops {
+		if !n.doc.Applied(op.ID) && !seen[op.ID] {
+			seen[op.ID] = true
+			fresh = append(fresh, op)
+		}
+	}
+	if err := n.logOps(fresh...); err != nil {
+		return err
+	}
+	dropped := n.doc.Dropped()
+	for _, op := range fresh {
+		n.doc.Apply(op)
+	}
+	if dropped = n.doc.Dropped() - dropped; dropped > 0 {
+		log.Printf("dropped %d operations from peers, too many epochs behind", dropped)
+	}
+	return n.takeOps() // a remote operation may trigger a rebalance
+}
+
+// takeOps journals the local operations and queues them for every peer, then takes a
+// snapshot if one is due. Callers hold mu.
+func (n *Node) takeOps() error {
+	ops := n.doc.TakeOps()
+	if err := n.logOps(ops...); err != nil {
+		return err
+	}
+	if n.journal != nil {
+		n.journal.snapshotDue(n.doc)
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	for _, p := range n.peers {
+		p.sender.send(ops)
+	}
+	return nil
+}
+
+// logOps journals operations, if the node has a journal. Callers hold mu.
+func (n *Node) logOps(ops ...document.Op) error {
+	if n.journal == nil {
+		return nil
+	}
+	return n.journal.append(ops...)
+}
+
+// retry calls dial until it succeeds, for a while, so that peers started at the same
+// time find each other listening.
+func retry(ctx context.Context, dial func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, dialPatience)
+	defer cancel()
+	for {
+		err := dial()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// siteID numbers the peers by the order of their addresses, so every peer of the
+// session gets a different one without extra arguments.
+func siteID(self string, peers []string) uint8 {
+	all := append([]string{self}, peers...)
+	sort.Strings(all)
+	return uint8(sort.SearchStrings(all, self) + 1)
+}
@@ -0,0 +1,444 @@
+package node
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"github.com/hesiyuan/EntangleText/transport"
+	"gotest.tools/assert"
+)
+
+// session starts a node for every address, all on one in-memory network and configured
+// like cfg otherwise
+func session(t *testing.T, net *transport.Network, cfg Config, addrs ...string) []*Node {
+	nodes := make([]*Node, len(addrs))
+	started := make(chan error)
+	for i, addr := range addrs {
+		var peers []string
+		for _, other := range addrs {
+			if other != addr {
+				peers = append(peers, other)
+			}
+		}
+		cfg.Addr, cfg.Peers, cfg.Transport = addr, peers, net.Node(addr)
+		n, err := New(cfg)
+		assert.NilError(t, err)
+		t.Cleanup(n.Stop)
+		nodes[i] = n
+		go func() { started <- n.Start(context.Background()) }()
+	}
+	for range addrs {
+		assert.NilError(t, <-started)
+	}
+	return nodes
+}
+
+// converged waits a while for every node to have content
+func converged(t *testing.T, content string, nodes ...*Node) {
+	for _, n := range nodes {
+		eventually(t, func() bool { return n.Content() == content })
+		assert.Equal(t, n.Content(), content, "site %d", n.SiteID())
+	}
+}
+
+func TestNodes(t *testing.T) {
+	nodes := session(t, transport.NewNetwork(1), Config{}, "a", "b", "c")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	assert.DeepEqual(t, b.Peers(), []string{"a", "c"})
+	assert.Equal(t, a.SiteID(), uint8(1))
+	assert.Equal(t, c.SiteID(), uint8(3))
+
+	assert.NilError(t, a.Insert(0, "Entangle"))
+	converged(t, "Entangle", nodes...)
+	assert.NilError(t, b.Append(" Text"))
+	assert.NilError(t, c.Delete(0, 3))
+	converged(t, "angle Text", nodes...)
+	assert.NilError(t, a.Insert(5, "d"))
+	converged(t, "angled Text", nodes...)
+	assert.Equal(t, a.Len(), 11)
+
+	assert.ErrorContains(t, a.Insert(12, "x"), "out of the document")
+	assert.ErrorContains(t, a.Delete(10, 2), "out of the document")
+}
+
+func TestCollectGarbage(t *testing.T) {
+	defer func(d time.Duration) { heartbeatEvery = d }(heartbeatEvery)
+	heartbeatEvery = 10 * time.Millisecond
+	nodes := session(t, transport.NewNetwork(1), Config{}, "a", "b", "c")
+	a, b := nodes[0], nodes[1]
+	assert.NilError(t, a.Insert(0, "Entangle Text"))
+	converged(t, "Entangle Text", nodes...)
+	assert.NilError(t, b.Delete(0, 9))
+	converged(t, "Text", nodes...)
+
+	// heartbeats tell every node that the others have seen the deletes
+	for _, n := range nodes {
+		eventually(t, func() bool {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			return n.doc.GCStats().Tombstones == 0
+		})
+	}
+	assert.NilError(t, a.Append("!"))
+	converged(t, "Text!", nodes...)
+}
+
+func TestFaultsAndPartition(t *testing.T) {
+	defer func(d time.Duration) { heartbeatEvery = d }(heartbeatEvery)
+	heartbeatEvery = 10 * time.Millisecond
+	net := transport.NewNetwork(1)
+	nodes := session(t, net, Config{BatchDelay: time.Millisecond}, "a", "b", "c")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	assert.NilError(t, a.Insert(0, "Entangle"))
+	converged(t, "Entangle", nodes...)
+
+	// lost batches come again once a heartbeat tells they are missing
+	net.SetFaults(transport.Faults{Latency: time.Millisecond, Jitter: 2 * time.Millisecond, Loss: 0.2, Reorder: 0.2})
+	for i := 0; i < 10; i++ {
+		for _, n := range nodes {
+			assert.NilError(t, n.Insert(0, string(rune('a'+n.SiteID()-1))))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	agree(t, len("Entangle")+30, nodes...)
+
+	// each side goes on, and they catch up once it heals
+	net.Partition([]string{"a", "b"}, []string{"c"})
+	assert.NilError(t, a.Append("!"))
+	assert.NilError(t, c.Delete(0, 3))
+	agree(t, len("Entangle")+31, a, b)
+	time.Sleep(5 * heartbeatEvery)
+	assert.Assert(t, !strings.HasSuffix(c.Content(), "!"))
+	net.Heal()
+	agree(t, len("Entangle")+28, nodes...)
+	assert.Assert(t, strings.HasSuffix(c.Content(), "Entangle!"))
+}
+
+// agree waits a while for the nodes to have the same content, of n characters
+func agree(t *testing.T, n int, nodes ...*Node) {
+	same := func() bool {
+		for _, other := range nodes[1:] {
+			if other.Content() != nodes[0].Content() {
+				return false
+			}
+		}
+		return len(nodes[0].Content()) == n
+	}
+	eventually(t, same)
+}
+
+// eventually waits a while for f to be true
+func eventually(t *testing.T, f func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Assert(t, f())
+}
+
+func TestJoin(t *testing.T) {
+	net := transport.NewNetwork(1)
+	nodes := session(t, net, Config{}, "a", "b")
+	a, b := nodes[0], nodes[1]
+	assert.NilError(t, a.Insert(0, "Entangle"))
+	converged(t, "Entangle", a, b)
+
+	c, err := New(Config{Addr: "c", Peers: []string{"a"}, Site: 3, Transport: net.Node("c")})
+	assert.NilError(t, err)
+	defer c.Stop()
+	assert.NilError(t, c.Start(context.Background()))
+	converged(t, "Entangle", c) // caught up
+	eventually(t, func() bool { return len(c.Peers()) == 2 && len(b.Peers()) == 2 })
+	assert.DeepEqual(t, c.Peers(), []string{"a", "b"})
+	assert.DeepEqual(t, b.Peers(), []string{"a", "c"})
+
+	assert.NilError(t, c.Append(" Text"))
+	assert.NilError(t, b.Insert(0, "_"))
+	converged(t, "_Entangle Text", a, b, c)
+
+	c.Stop()
+	eventually(t, func() bool { return len(a.Peers()) == 1 && len(b.Peers()) == 1 })
+}
+
+// crash stops a node the way a crash would, without a word to its peers.
+func crash(n *Node) {
+	n.stopped.Do(func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		close(n.stopping)
+		n.listener.Close()
+		n.cancel()
+		for _, p := range n.peers {
+			p.close()
+		}
+		for _, c := range n.accepted {
+			c.Close()
+		}
+		n.journal.close()
+	})
+}
+
+func TestCrashAndRestart(t *testing.T) {
+	net := transport.NewNetwork(1)
+	dir := t.TempDir()
+	cfg := func(addr, peer string) Config {
+		return Config{Addr: addr, Peers: []string{peer}, Transport: net.Node(addr), Journal: filepath.Join(dir, addr+".wal")}
+	}
+	a, err := New(cfg("a", "b"))
+	assert.NilError(t, err)
+	defer a.Stop()
+	b, err := New(cfg("b", "a"))
+	assert.NilError(t, err)
+	started := make(chan error)
+	go func() { started <- a.Start(context.Background()) }()
+	assert.NilError(t, b.Start(context.Background()))
+	assert.NilError(t, <-started)
+	assert.NilError(t, a.Insert(0, "Entangle"))
+	converged(t, "Entangle", a, b)
+
+	crash(b)
+	assert.NilError(t, a.Append(" Text")) // missed by b
+	b, err = New(cfg("b", "a"))
+	assert.NilError(t, err)
+	defer b.Stop()
+	assert.NilError(t, b.Start(context.Background()))
+	converged(t, "Entangle Text", b)
+
+	// edits flow both ways again
+	assert.NilError(t, a.Append("!"))
+	assert.NilError(t, b.Insert(0, "_"))
+	converged(t, "_Entangle Text!", a, b)
+	assert.DeepEqual(t, a.Peers(), []string{"b"})
+}
+
+func TestEvents(t *testing.T) {
+	nodes := session(t, transport.NewNetwork(1), Config{}, "a", "b")
+	a, b := nodes[0], nodes[1]
+	events := b.Events()
+	assert.NilError(t, a.Insert(0, "abc"))
+	e := <-events
+	assert.Equal(t, len(e.Ops), 3) // one change
+	assert.Assert(t, !e.Local)
+	assert.NilError(t, b.Delete(1, 1))
+	e = <-events
+	assert.Equal(t, len(e.Ops), 1)
+	assert.Assert(t, e.Local)
+
+	b.Stop()
+	_, ok := <-events
+	assert.Assert(t, !ok)
+}
+
+func TestUndo(t *testing.T) {
+	nodes := session(t, transport.NewNetwork(1), Config{}, "a", "b")
+	a, b := nodes[0], nodes[1]
+	events := a.Events()
+	assert.NilError(t, a.Insert(0, "Entangle"))
+	<-events
+	converged(t, "Entangle", a, b) // or b could append ahead of it
+	assert.NilError(t, b.Append(" Text"))
+	converged(t, "Entangle Text", a, b)
+	remote := <-events
+
+	undone, err := a.Undo()
+	assert.NilError(t, err)
+	assert.Assert(t, undone)
+	converged(t, " Text", a, b)
+	undone, err = a.Undo()
+	assert.NilError(t, err)
+	assert.Assert(t, !undone) // the edits of b are its own
+	redone, err := a.Redo()
+	assert.NilError(t, err)
+	assert.Assert(t, redone)
+	converged(t, "Entangle Text", a, b)
+
+	assert.NilError(t, a.Revert(remote.Ops[0].ID))
+	converged(t, "Entangle", a, b)
+	a.Stop()
+	assert.Equal(t, a.Revert(remote.Ops[0].ID), ErrStopped)
+	_, err = a.Undo()
+	assert.Equal(t, err, ErrStopped)
+}
+
+func TestStopSendsQueued(t *testing.T) {
+	nodes := session(t, transport.NewNetwork(1), Config{BatchDelay: time.Hour}, "a", "b")
+	a, b := nodes[0], nodes[1]
+	assert.NilError(t, a.Insert(0, "bye"))
+	a.Stop()
+	converged(t, "bye", b)
+	assert.Equal(t, a.Insert(0, "x"), ErrStopped)
+	assert.Equal(t, a.Content(), "bye")
+}
+
+func TestStartCanceled(t *testing.T) {
+	net := transport.NewNetwork(1)
+	n, err := New(Config{Addr: "a", Peers: []string{"nobody"}, Transport: net.Node("a")})
+	assert.NilError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	assert.Equal(t, n.Start(ctx), context.Canceled)
+
+	// the context stops a node that started
+	ctx, cancel = context.WithCancel(context.Background())
+	session(t, net, Config{}, "b")
+	n, err = New(Config{Addr: "c", Peers: []string{"b"}, Transport: net.Node("c")})
+	assert.NilError(t, err)
+	assert.NilError(t, n.Start(ctx))
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for n.Append("x") != ErrStopped && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, n.Append("x"), ErrStopped)
+}
+
+func TestRestart(t *testing.T) {
+	cfg := Config{Addr: "b", Peers: []string{"a"}, Journal: filepath.Join(t.TempDir(), "b.wal")}
+	n, err := New(cfg)
+	assert.NilError(t, err)
+	assert.NilError(t, n.Insert(0, "Entangle"))
+	n.Stop()
+
+	cfg.Site = 7 // the journal knows better
+	n, err = New(cfg)
+	assert.NilError(t, err)
+	defer n.Stop()
+	assert.Equal(t, n.Content(), "Entangle")
+	assert.Equal(t, n.SiteID(), uint8(2))
+
+	d, err := ReadJournal(cfg.Journal)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Content(), "Entangle")
+}
+
+func TestRemoteOpsJournaledFirst(t *testing.T) {
+	n, err := New(Config{Addr: "a", Journal: filepath.Join(t.TempDir(), "a.wal")})
+	assert.NilError(t, err)
+	defer n.Stop()
+	peer := document.NewDocument(nil, 2)
+	peer.InsertRight(document.Start, "x")
+	ops := peer.TakeOps()
+
+	n.journal.log.Close() // every append fails
+	assert.Assert(t, n.applyRemote(ops) != nil)
+	assert.Equal(t, n.Content(), "") // so that the peer sends it again
+	assert.Assert(t, !n.doc.Applied(ops[0].ID))
+}
+
+func TestCheckJournal(t *testing.T) {
+	cfg := Config{Addr: "a", Journal: filepath.Join(t.TempDir(), "a.wal"), SnapshotOps: 3}
+	n, err := New(cfg)
+	assert.NilError(t, err)
+	assert.NilError(t, n.Insert(0, "ab"))
+	assert.NilError(t, n.Insert(0, "cd")) // snapshot
+	assert.NilError(t, n.Append("e"))
+	n.Stop()
+
+	r, err := CheckJournal(cfg.Journal)
+	assert.NilError(t, err)
+	assert.Equal(t, len(r.Problems), 0, "%v", r.Problems)
+	assert.Equal(t, len(r.Snapshots), 1)
+	assert.Equal(t, r.Ops, 5) // the first snapshot drops nothing
+	d, err := ReadLog(cfg.Journal)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Content(), "cdabe")
+
+	assert.NilError(t, os.WriteFile(r.Snapshots[0], []byte("garbage"), 0644))
+	r, err = CheckJournal(cfg.Journal)
+	assert.NilError(t, err)
+	assert.Equal(t, len(r.Problems), 1)
+}
+
+func TestHistoryOutsideSnapshots(t *testing.T) {
+	defer func(size int64) { historySegment = size }(historySegment)
+	historySegment = 1 // a segment for every record
+	cfg := Config{Addr: "a", Journal: filepath.Join(t.TempDir(), "a.wal"), SnapshotOps: 2}
+	n, err := New(cfg)
+	assert.NilError(t, err)
+	for _, s := range []string{"E", "n", "t", "a", "n", "g", "l", "e"} {
+		assert.NilError(t, n.Append(s)) // a snapshot every other one
+	}
+	n.Stop()
+
+	r, err := CheckJournal(cfg.Journal)
+	assert.NilError(t, err)
+	assert.Equal(t, len(r.Problems), 0, "%v", r.Problems)
+	assert.Equal(t, r.History+r.Ops, 8) // each in one of them
+	assert.Assert(t, r.History >= 4)
+	segments, _ := filepath.Glob(cfg.Journal + ".history.*")
+	assert.Assert(t, len(segments) > 1, "%v", segments)
+
+	d, err := ReadJournal(cfg.Journal)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Content(), "Entangle")
+	assert.Equal(t, len(d.History()), 8)
+	assert.Equal(t, d.AtIndex(3).Content(), "Ent")
+
+	// a node only reads the history log once it needs an operation from it
+	n, err = New(cfg)
+	assert.NilError(t, err)
+	assert.Equal(t, n.Content(), "Entangle")
+	assert.Equal(t, len(n.doc.History()), r.Ops)
+	assert.NilError(t, n.Revert(document.OpID{Site: n.SiteID(), Clock: 1}))
+	assert.Equal(t, n.Content(), "ntangle")
+	assert.Equal(t, len(n.doc.History()), 9)
+	n.Stop()
+
+	// without snapshots, the history log has what the journal dropped
+	snaps, _ := filepath.Glob(cfg.Journal + ".snap.*")
+	for _, s := range snaps {
+		assert.NilError(t, os.Remove(s))
+	}
+	d, err = ReadJournal(cfg.Journal)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Content(), "ntangle")
+}
+
+func TestRPCNeedsTCP(t *testing.T) {
+	_, err := New(Config{Addr: "a", Transport: transport.NewNetwork(1).Node("a"), AntiEntropy: time.Second})
+	assert.ErrorContains(t, err, "net/rpc")
+}
+
+// freeAddr returns a local TCP address nothing listens at
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestLeaveRPC(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	nodes := make([]*Node, len(addrs))
+	for i, addr := range addrs {
+		n, err := New(Config{Addr: addr, Peers: addrs, LegacyRPC: true, BatchDelay: time.Millisecond})
+		assert.NilError(t, err)
+		defer n.Stop()
+		nodes[i] = n
+	}
+	errs := make(chan error, len(nodes))
+	for _, n := range nodes {
+		go func(n *Node) { errs <- n.Start(context.Background()) }(n)
+	}
+	for range nodes {
+		assert.NilError(t, <-errs)
+	}
+	a, b := nodes[0], nodes[1]
+	assert.NilError(t, a.Insert(0, "Entangle"))
+	converged(t, "Entangle", b)
+
+	// the calls of single characters from before operations are gone
+	a.mu.Lock()
+	p := a.peers[0]
+	a.mu.Unlock()
+	assert.ErrorContains(t, a.call(p, "EntangleClient.Insert", &OpsArgs{}, new(ValReply)), "can't find method")
+
+	a.Stop()
+	eventually(t, func() bool { return len(b.Peers()) == 0 })
+}
@@ -0,0 +1,148 @@
+package node
+
+// the queues of operations waiting to be sent to every peer
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"github.com/hesiyuan/EntangleText/protocol"
+)
+
+// maxInflight is the number of batches sent to a peer that may wait for a reply. Past
+// that, operations queue up and leave in bigger batches when the peer catches up.
+const maxInflight = 4
+
+// sender sends operations to a peer in batches, in the background, so that a slow peer
+// does not hold anything up. Operations are sent once BatchDelay has passed since the
+// first of them was queued, or once there are BatchOps of them.
+type sender struct {
+	n *Node
+	p *peer
+
+	mu       sync.Mutex
+	queue    []document.Op
+	wake     chan struct{} // something was queued
+	finished chan struct{} // closed once everything queued before Stop was sent
+	gone     chan struct{} // closed when the peer left, and nothing is sent anymore
+}
+
+func (n *Node) newSender(p *peer) *sender {
+	s := &sender{n: n, p: p, wake: make(chan struct{}, 1), finished: make(chan struct{}), gone: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+// send queues operations for the peer. It never blocks.
+func (s *sender) send(ops []document.Op) {
+	s.mu.Lock()
+	s.queue = append(s.queue, ops...)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued operations, BatchOps at most per call and maxInflight calls at
+// once. With the framed protocol, batches are messages that get no reply. A heartbeat
+// with the version vector of the node goes out every heartbeatEvery, so that the peer
+// learns which tombstones it may collect. When the node stops, it sends what is left
+// without waiting, then waits for the replies.
+func (s *sender) run() {
+	defer close(s.finished)
+	done := make(chan error, maxInflight)
+	inflight := 0
+	var flush <-chan time.Time // not nil while the first operations wait for more
+	stopping := s.n.stopping
+	heartbeat := time.NewTicker(heartbeatEvery)
+	defer heartbeat.Stop()
+	for {
+		if stopping == nil && inflight == 0 && s.idle() {
+			return
+		}
+		select {
+		case <-stopping:
+			stopping, flush = nil, nil
+		case <-s.n.ctx.Done():
+			return
+		case <-s.gone:
+			return
+		case now := <-heartbeat.C:
+			s.n.mu.Lock()
+			have := s.n.doc.Version()
+			s.n.mu.Unlock()
+			if s.p.conn != nil {
+				s.sendFramed(protocol.Message{Type: protocol.Heartbeat, Time: now.UnixNano(), Site: s.n.SiteID(), Have: have})
+			} else if inflight < maxInflight {
+				args := &OpsArgs{Clientid: s.n.SiteID(), Version: have}
+				go func() { done <- s.n.call(s.p, "EntangleClient.Ops", args, new(ValReply)) }()
+				inflight++
+			}
+		case <-s.wake:
+			if flush == nil {
+				flush = time.After(s.n.cfg.BatchDelay)
+			}
+		case <-flush:
+			flush = nil
+		case err := <-done:
+			inflight--
+			if err != nil {
+				log.Printf("sending operations to %s failed: %v", s.p.addr, err)
+			}
+		}
+		for inflight < maxInflight {
+			batch := s.take(flush == nil)
+			if batch == nil {
+				break
+			}
+			if s.p.conn != nil {
+				s.sendFramed(protocol.Message{Type: protocol.Batch, Ops: batch})
+				continue
+			}
+			packed, err := document.MarshalOps(batch)
+			if err != nil {
+				log.Printf("encoding %d operations for %s failed: %v", len(batch), s.p.addr, err)
+				continue
+			}
+			args := &OpsArgs{Clientid: s.n.SiteID(), Packed: packed}
+			go func() { done <- s.n.call(s.p, "EntangleClient.Ops", args, new(ValReply)) }()
+			inflight++
+		}
+	}
+}
+
+// sendFramed sends a message with the framed protocol.
+func (s *sender) sendFramed(m protocol.Message) {
+	if err := s.p.conn.Send(m); err != nil {
+		log.Printf("sending %v to %s failed: %v", m.Type, s.p.addr, err)
+	}
+}
+
+// idle reports whether nothing is queued.
+func (s *sender) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue) == 0
+}
+
+// take removes the next batch from the queue, if it is full or if all is true.
+func (s *sender) take(all bool) []document.Op {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, max := len(s.queue), s.n.cfg.BatchOps
+	if n == 0 || n < max && !all {
+		return nil
+	}
+	if n > max {
+		n = max
+	}
+	batch := s.queue[:n:n]
+	s.queue = s.queue[n:]
+	if len(s.queue) == 0 {
+		s.queue = nil // do not keep the batches alive through the queue
+	}
+	return batch
+}
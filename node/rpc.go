@@ -0,0 +1,187 @@
+package node
+
+// the net/rpc service of a node, for anti-entropy and for peers that do not speak the
+// framed protocol
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"github.com/hesiyuan/EntangleText/protocol"
+)
+
+// args in disconnect(args)
+type DisconnectArgs struct {
+	Clientid uint8  // client id who voluntarilly quit the editor
+	Addr     string // address it listened at, empty for clients from before there was one
+}
+
+// Reply from service for all the API calls above.
+// This is actually not gonna be used.
+type ValReply struct {
+	Val string // value; depends on the call
+}
+
+// args in sync(args)
+type SyncArgs struct {
+	Clientid uint8                  // client id asking to catch up
+	Version  document.VersionVector // operations the client already has
+}
+
+// args in ops(args)
+type OpsArgs struct {
+	Clientid uint8 // client id sending the operations
+	Ops      []document.Op
+	Packed   []byte                 // more operations, encoded with document.MarshalOps
+	Version  document.VersionVector // operations the client has, sent now and then
+}
+
+// Reply to sync: the operations the client is missing.
+type SyncReply struct {
+	Ops      []document.Op
+	Packed   []byte // more operations, encoded with document.MarshalOps
+	Complete bool   // false if the client is too far behind and needs a full copy
+}
+
+// args in digests(args)
+type DigestArgs struct {
+	Nodes []int // nodes of the Merkle tree whose digests are wanted
+}
+
+// Reply to digests.
+type DigestReply struct {
+	Digests []uint64
+}
+
+// args in slice(args)
+type SliceArgs struct {
+	Leaves []int // leaves of the Merkle tree to send the pairs of
+}
+
+// unpack returns the operations sent as they are and the packed ones.
+func unpack(ops []document.Op, packed []byte) ([]document.Op, error) {
+	more, err := document.UnmarshalOps(packed)
+	return append(ops, more...), err
+}
+
+// service is the net/rpc service of a node, registered as EntangleClient.
+type service struct {
+	n *Node
+}
+
+// DISCONNECT from a peer.
+func (s *service) Disconnect(args *DisconnectArgs, reply *ValReply) error {
+	log.Printf("site %d left the session", args.Clientid)
+	s.n.leave(args.Clientid, args.Addr)
+	return nil
+}
+
+// OPS from a peer. They are in the journal before the call returns.
+func (s *service) Ops(args *OpsArgs, reply *ValReply) error {
+	ops, err := unpack(args.Ops, args.Packed)
+	if err != nil {
+		return err
+	}
+	if args.Version != nil {
+		s.n.observe(args.Clientid, args.Version)
+	}
+	return s.n.applyRemote(ops)
+}
+
+// SYNC: a peer that reconnects sends its version vector and gets back only the
+// operations it missed.
+func (s *service) Sync(args *SyncArgs, reply *SyncReply) error {
+	n := s.n
+	n.observe(args.Clientid, args.Version)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ops, complete := n.doc.OpsSince(args.Version)
+	packed, err := document.MarshalOps(ops)
+	reply.Packed, reply.Complete = packed, complete
+	return err
+}
+
+// DIGESTS of the Merkle tree, for anti-entropy.
+func (s *service) Digests(args *DigestArgs, reply *DigestReply) error {
+	n := s.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply.Digests = make([]uint64, len(args.Nodes))
+	for i, node := range args.Nodes {
+		if node < document.MerkleRoot || node >= 2*document.MerkleLeaves {
+			return fmt.Errorf("no Merkle node %d", node)
+		}
+		reply.Digests[i] = n.doc.Digest(node)
+	}
+	return nil
+}
+
+// SLICE of the document, for anti-entropy to repair the ranges that differ.
+func (s *service) Slice(args *SliceArgs, reply *document.Slice) error {
+	n := s.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	*reply = n.doc.Slice(args.Leaves)
+	return nil
+}
+
+// syncWith catches up with a peer by applying the operations it has and we do not.
+// With the framed protocol, they are applied when the reply comes.
+func (n *Node) syncWith(p *peer) error {
+	n.mu.Lock()
+	args := SyncArgs{Clientid: n.doc.SiteID(), Version: n.doc.Version()}
+	n.mu.Unlock()
+	if p.conn != nil {
+		return p.conn.Send(protocol.Message{Type: protocol.Sync, Site: args.Clientid, Have: args.Version})
+	}
+
+	var reply SyncReply
+	if err := n.call(p, "EntangleClient.Sync", &args, &reply); err != nil {
+		return err
+	}
+	if !reply.Complete {
+		return fmt.Errorf("too far behind, a full copy of the document is needed")
+	}
+	ops, err := unpack(reply.Ops, reply.Packed)
+	if err != nil {
+		return err
+	}
+	return n.applyRemote(ops)
+}
+
+// antiEntropy compares the document with the one of a peer and repairs the ranges that
+// differ, which catches edits lost on the way.
+func (n *Node) antiEntropy(p *peer) error {
+	n.mu.Lock()
+	leaves, err := n.doc.Diff(func(nodes []int) ([]uint64, error) {
+		// the peer may be comparing with us at the same time
+		n.mu.Unlock()
+		defer n.mu.Lock()
+		var reply DigestReply
+		err := n.call(p, "EntangleClient.Digests", &DigestArgs{Nodes: nodes}, &reply)
+		return reply.Digests, err
+	})
+	n.mu.Unlock()
+	if err != nil || len(leaves) == 0 {
+		return err
+	}
+
+	ranges := make([]string, len(leaves))
+	for i, l := range leaves {
+		lo, hi := document.LeafRange(l)
+		ranges[i] = fmt.Sprintf("%d-%d", lo, hi)
+	}
+	log.Printf("diverged from %s in ranges %s", p.addr, strings.Join(ranges, " "))
+
+	var slice document.Slice
+	if err := n.call(p, "EntangleClient.Slice", &SliceArgs{Leaves: leaves}, &slice); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	count := n.doc.Repair(slice) // not journaled, anti-entropy repairs it again after a crash
+	n.mu.Unlock()
+	log.Printf("repaired %d pairs from %s", count, p.addr)
+	return nil
+}
@@ -0,0 +1,321 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/hesiyuan/EntangleText/document"
+)
+
+// MsgType tells what a message is about.
+type MsgType uint8
+
+// Types of messages. New types are only ever added at the end.
+const (
+	Hello      MsgType = iota + 1 // opens the handshake: MinVersion, MaxVersion, Site
+	Welcome                       // accepts it: Version, Site
+	Error                         // Text, why a request failed
+	Insert                        // Op, an insert
+	Delete                        // Op, a delete
+	Batch                         // Ops, any operations
+	Sync                          // Site, Have: asks for the operations the sender misses
+	Heartbeat                     // Time, and Site, Have if known: the sender is alive, and what it applied
+	Presence                      // Site, Cursor, Name: where a user is in the document
+	Disconnect                    // Site: the sender is leaving the session
+	Join                          // Site, Addr: the sender is a member that listens at Addr
+	Members                       // Peers: the members of the session, answering a Join
+)
+
+var typeNames = []string{"", "Hello", "Welcome", "Error", "Insert", "Delete", "Batch", "Sync", "Heartbeat", "Presence", "Disconnect", "Join", "Members"}
+
+func (t MsgType) String() string {
+	if int(t) < len(typeNames) && t != 0 {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("MsgType(%d)", uint8(t))
+}
+
+// Message is a message of the protocol. Only the fields of its type are sent.
+type Message struct {
+	Type MsgType
+
+	MinVersion, MaxVersion int // protocol versions the sender of a Hello speaks
+	Version                int // protocol version chosen in a Welcome
+	Site                   uint8
+
+	Text   string                 // reason of an Error
+	Op     document.Op            // operation of an Insert or Delete
+	Ops    []document.Op          // operations of a Batch
+	Have   document.VersionVector // operations the sender of a Sync or Heartbeat already has
+	Time   int64                  // Unix nanoseconds a Heartbeat was sent at
+	Cursor []document.Identifier  // position of the cursor in a Presence, empty for none
+	Name   string                 // name of the user in a Presence
+	Addr   string                 // address the sender of a Join listens at
+	Peers  []string               // addresses of the members in a Members
+}
+
+var errShort = errors.New("protocol: truncated message")
+
+// MarshalBinary encodes the type and the payload of the message, as in version 1 of the
+// protocol.
+func (m Message) MarshalBinary() ([]byte, error) {
+	return m.Marshal(1)
+}
+
+// Marshal encodes the type and the payload of the message in version v of the
+// protocol. From version 2, positions are encoded with document.PosVarint instead of
+// PosBytes.
+func (m Message) Marshal(v int) ([]byte, error) {
+	b := []byte{byte(m.Type)}
+	varint := v >= 2
+	switch m.Type {
+	case Hello:
+		b = binary.AppendUvarint(b, uint64(m.MinVersion))
+		b = binary.AppendUvarint(b, uint64(m.MaxVersion))
+		b = append(b, m.Site)
+	case Welcome:
+		b = binary.AppendUvarint(b, uint64(m.Version))
+		b = append(b, m.Site)
+	case Error:
+		b = appendString(b, m.Text)
+	case Insert, Delete:
+		if !carries(m.Type, m.Op) {
+			return nil, fmt.Errorf("protocol: %v message with another kind of operation", m.Type)
+		}
+		marshal := m.Op.MarshalBinary
+		if varint {
+			marshal = m.Op.MarshalVarint
+		}
+		op, err := marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, op...)
+	case Batch:
+		marshal := document.MarshalOps
+		if varint {
+			marshal = document.MarshalOpsVarint
+		}
+		ops, err := marshal(m.Ops)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, ops...)
+	case Sync:
+		b = append(b, m.Site)
+		b = appendVersion(b, m.Have)
+	case Heartbeat:
+		b = binary.AppendVarint(b, m.Time)
+		if m.Have != nil { // older peers stop reading after Time
+			b = append(b, m.Site)
+			b = appendVersion(b, m.Have)
+		}
+	case Presence:
+		if len(m.Cursor) > 255 {
+			return nil, errors.New("protocol: cursor position too long to encode")
+		}
+		b = append(b, m.Site)
+		if varint {
+			b = append(b, document.PosVarint(m.Cursor)...)
+		} else if len(m.Cursor) == 0 {
+			b = append(b, 0)
+		} else {
+			b = append(b, document.PosBytes(m.Cursor)...)
+		}
+		b = appendString(b, m.Name)
+	case Disconnect:
+		b = append(b, m.Site)
+	case Join:
+		b = append(b, m.Site)
+		b = appendString(b, m.Addr)
+	case Members:
+		b = binary.AppendUvarint(b, uint64(len(m.Peers)))
+		for _, p := range m.Peers {
+			b = appendString(b, p)
+		}
+	default:
+		return nil, fmt.Errorf("protocol: cannot send a message of type %v", m.Type)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a message encoded by MarshalBinary.
+func (m *Message) UnmarshalBinary(b []byte) error {
+	return m.Unmarshal(b, 1)
+}
+
+// Unmarshal decodes a message encoded by Marshal in version v of the protocol.
+func (m *Message) Unmarshal(b []byte, v int) error {
+	*m = Message{}
+	varint := v >= 2
+	if len(b) == 0 {
+		return errShort
+	}
+	m.Type, b = MsgType(b[0]), b[1:]
+	var err error
+	switch m.Type {
+	case Hello:
+		var min, max uint64
+		min, b, err = uvarint(b)
+		if err == nil {
+			max, b, err = uvarint(b)
+		}
+		if err == nil {
+			m.Site, _, err = byte1(b)
+		}
+		m.MinVersion, m.MaxVersion = int(min), int(max)
+	case Welcome:
+		var v uint64
+		v, b, err = uvarint(b)
+		if err == nil {
+			m.Site, _, err = byte1(b)
+		}
+		m.Version = int(v)
+	case Error:
+		m.Text, _, err = str(b)
+	case Insert, Delete:
+		unmarshal := m.Op.UnmarshalBinary
+		if varint {
+			unmarshal = m.Op.UnmarshalVarint
+		}
+		if err = unmarshal(b); err == nil && !carries(m.Type, m.Op) {
+			err = fmt.Errorf("protocol: %v message with another kind of operation", m.Type)
+		}
+	case Batch:
+		unmarshal := document.UnmarshalOps
+		if varint {
+			unmarshal = document.UnmarshalOpsVarint
+		}
+		m.Ops, err = unmarshal(b)
+	case Sync:
+		m.Site, b, err = byte1(b)
+		if err == nil {
+			m.Have, _, err = version(b)
+		}
+	case Heartbeat:
+		var n int
+		if m.Time, n = binary.Varint(b); n <= 0 {
+			err = errShort
+		} else if b = b[n:]; len(b) > 0 {
+			m.Site, b, err = byte1(b)
+			if err == nil {
+				m.Have, _, err = version(b)
+			}
+		}
+	case Presence:
+		m.Site, b, err = byte1(b)
+		if err == nil && varint {
+			m.Cursor, b, err = posVarint(b)
+		} else if err == nil {
+			m.Cursor, b, err = pos(b)
+		}
+		if err == nil {
+			m.Name, _, err = str(b)
+		}
+	case Disconnect:
+		m.Site, _, err = byte1(b)
+	case Join:
+		m.Site, b, err = byte1(b)
+		if err == nil {
+			m.Addr, _, err = str(b)
+		}
+	case Members:
+		var n uint64
+		n, b, err = uvarint(b)
+		if err == nil && n > uint64(len(b)) {
+			err = errShort
+		}
+		for i := uint64(0); i < n && err == nil; i++ {
+			var p string
+			p, b, err = str(b)
+			m.Peers = append(m.Peers, p)
+		}
+	}
+	return err
+}
+
+// carries reports whether an Insert or Delete message may carry the operation.
+func carries(t MsgType, op document.Op) bool {
+	return t == Insert && op.Kind == document.InsertOp || t == Delete && op.Kind == document.DeleteOp
+}
+
+func byte1(b []byte) (byte, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errShort
+	}
+	return b[0], b[1:], nil
+}
+
+func uvarint(b []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errShort
+	}
+	return v, b[n:], nil
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+func str(b []byte) (string, []byte, error) {
+	n, b, err := uvarint(b)
+	if err != nil || n > uint64(len(b)) {
+		return "", nil, errShort
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func appendVersion(b []byte, vv document.VersionVector) []byte {
+	b = binary.AppendUvarint(b, uint64(len(vv)))
+	for site, clock := range vv {
+		b = append(b, site)
+		b = binary.AppendUvarint(b, clock)
+	}
+	return b
+}
+
+func version(b []byte) (document.VersionVector, []byte, error) {
+	n, b, err := uvarint(b)
+	if err == nil && n > uint64(len(b)) {
+		err = errShort
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	vv := make(document.VersionVector, n)
+	for i := uint64(0); i < n && err == nil; i++ {
+		var site byte
+		var clock uint64
+		if site, b, err = byte1(b); err == nil {
+			clock, b, err = uvarint(b)
+		}
+		vv[site] = clock
+	}
+	return vv, b, err
+}
+
+// pos decodes a position encoded with PosBytes, or a 0 byte for none.
+func pos(b []byte) ([]document.Identifier, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errShort
+	}
+	n := 1 + 3*int(b[0])
+	if b[0] == 0 {
+		return nil, b[1:], nil
+	}
+	if len(b) < n {
+		return nil, nil, errShort
+	}
+	return document.NewPos(b[:n]), b[n:], nil
+}
+
+// posVarint decodes a position encoded with PosVarint.
+func posVarint(b []byte) ([]document.Identifier, []byte, error) {
+	p, n := document.NewPosVarint(b)
+	if n == 0 {
+		return nil, nil, errShort
+	}
+	return p, b[n:], nil
+}
@@ -0,0 +1,182 @@
+// Package protocol implements the framed binary protocol clients use to talk to each
+// other.
+//
+// A connection starts with a handshake. The side that connects sends Magic and a Hello
+// message with the range of protocol versions it speaks and its site ID; the other side
+// answers with a Welcome message with the version they will use and its own site ID, or
+// with an Error message if they have no version in common. After that, either side may
+// send any message at any time.
+//
+// Every message is a frame: its length, 4 bytes big-endian, then its type, one byte,
+// then its payload. In version 1, positions are encoded with document.PosBytes, an empty
+// one as a 0 byte, and operations with their MarshalBinary method or
+// document.MarshalOps. Version 2 encodes positions with document.PosVarint instead, and
+// operations with MarshalVarint or document.MarshalOpsVarint. The number of an
+// identifier then takes 1 to 3 bytes instead of 2: fewer for the small numbers of deep
+// positions, more for the numbers boundary allocation and rebalancing spread over the
+// whole 16 bits. Everything else is the same in both.
+//
+// A Heartbeat goes out at a fixed period, batches or not. After the time it was sent, it
+// carries the site ID and the version vector of the sender, so that the peer learns
+// which tombstones every site has seen and may be collected, and whether messages of the
+// sender were lost, which it then asks for again with a Sync. Peers that only read the
+// time ignore the rest, so this needed no new version.
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Magic starts every connection, so that a server can tell the protocol from others
+// on the same port.
+const Magic = "ENTG"
+
+// The protocol versions this package speaks.
+const (
+	MinVersion = 1
+	MaxVersion = 2
+)
+
+// MaxFrame is the size of the largest frame accepted.
+const MaxFrame = 64 << 20
+
+// ErrVersion is returned by the handshake when both sides have no protocol version in
+// common.
+var ErrVersion = errors.New("protocol: no common version")
+
+// Conn is a connection speaking the protocol. Send may be called from several goroutines
+// at once, Receive from one at a time.
+type Conn struct {
+	Version int   // version agreed on in the handshake
+	Site    uint8 // site ID of the other side
+
+	rw io.ReadWriteCloser
+	r  *bufio.Reader
+
+	mu  sync.Mutex // serializes Send
+	buf []byte
+}
+
+// Connect performs the handshake on a connection it opened, for site.
+func Connect(rw io.ReadWriteCloser, site uint8) (*Conn, error) {
+	c := &Conn{rw: rw, r: bufio.NewReader(rw)}
+	if _, err := io.WriteString(rw, Magic); err != nil {
+		return nil, err
+	}
+	if err := c.Send(Message{Type: Hello, MinVersion: MinVersion, MaxVersion: MaxVersion, Site: site}); err != nil {
+		return nil, err
+	}
+	m, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	switch m.Type {
+	case Welcome:
+		if m.Version < MinVersion || m.Version > MaxVersion {
+			return nil, fmt.Errorf("%w: the server chose version %d", ErrVersion, m.Version)
+		}
+		c.Version, c.Site = m.Version, m.Site
+		return c, nil
+	case Error:
+		if m.Text == ErrVersion.Error() {
+			return nil, ErrVersion
+		}
+		return nil, fmt.Errorf("protocol: handshake refused: %s", m.Text)
+	}
+	return nil, fmt.Errorf("protocol: unexpected message %v in the handshake", m.Type)
+}
+
+// Accept performs the handshake on a connection it accepted, for site. The connection
+// is read through r, which Sniff may have peeked at, or through a new reader if r is
+// nil.
+func Accept(rw io.ReadWriteCloser, r *bufio.Reader, site uint8) (*Conn, error) {
+	if r == nil {
+		r = bufio.NewReader(rw)
+	}
+	c := &Conn{rw: rw, r: r}
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != Magic {
+		return nil, errors.New("protocol: not a connection of this protocol")
+	}
+	m, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != Hello {
+		return nil, fmt.Errorf("protocol: unexpected message %v in the handshake", m.Type)
+	}
+	v := m.MaxVersion
+	if v > MaxVersion {
+		v = MaxVersion
+	}
+	if v < m.MinVersion || v < MinVersion {
+		c.Send(Message{Type: Error, Text: ErrVersion.Error()})
+		return nil, ErrVersion
+	}
+	c.Version, c.Site = v, m.Site
+	if err := c.Send(Message{Type: Welcome, Version: v, Site: site}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Sniff reports whether a connection read through r speaks the protocol, without
+// consuming anything.
+func Sniff(r *bufio.Reader) bool {
+	b, _ := r.Peek(len(Magic))
+	return bytes.Equal(b, []byte(Magic))
+}
+
+// Send sends a message.
+func (c *Conn) Send(m Message) error {
+	payload, err := m.Marshal(c.Version)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MaxFrame {
+		return fmt.Errorf("protocol: message of %d bytes is too large", len(payload))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = binary.BigEndian.AppendUint32(c.buf[:0], uint32(len(payload)))
+	c.buf = append(c.buf, payload...)
+	_, err = c.rw.Write(c.buf)
+	return err
+}
+
+// Receive waits for the next message. A message of a type this version does not know
+// is returned with only its type set.
+func (c *Conn) Receive() (Message, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return Message{}, err
+	}
+	n := binary.BigEndian.Uint32(h[:])
+	if n == 0 || n > MaxFrame {
+		return Message{}, fmt.Errorf("protocol: bad frame of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Message{}, err
+	}
+	var m Message
+	err := m.Unmarshal(b, c.Version)
+	return m, err
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.rw.Close()
+}
@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/hesiyuan/EntangleText/document"
+	"gotest.tools/assert"
+)
+
+var messages = []Message{
+	{Type: Hello, MinVersion: 1, MaxVersion: 3, Site: 2},
+	{Type: Welcome, Version: 1, Site: 1},
+	{Type: Error, Text: "too far behind"},
+	{Type: Insert, Op: document.Op{Kind: document.InsertOp, ID: document.OpID{Site: 1, Clock: 7}, Pos: []document.Identifier{{Ident: 3, Site: 1}}, Atom: "x"}},
+	{Type: Delete, Op: document.Op{Kind: document.DeleteOp, ID: document.OpID{Site: 2, Clock: 1}, Pos: []document.Identifier{{Ident: 3, Site: 1}}, Target: document.OpID{Site: 1, Clock: 7}}},
+	{Type: Batch, Ops: []document.Op{
+		{Kind: document.InsertOp, ID: document.OpID{Site: 1, Clock: 8}, Pos: []document.Identifier{{Ident: 4, Site: 1}}, Atom: "y"},
+		{Kind: document.InsertOp, ID: document.OpID{Site: 1, Clock: 9}, Pos: []document.Identifier{{Ident: 9, Site: 1}}, Atom: "z"},
+	}},
+	{Type: Sync, Site: 3, Have: document.VersionVector{1: 9, 2: 1}},
+	{Type: Heartbeat, Time: 1e18},
+	{Type: Heartbeat, Time: -5, Site: 2, Have: document.VersionVector{2: 300}},
+	{Type: Presence, Site: 3, Cursor: []document.Identifier{{Ident: 4, Site: 1}, {Ident: 1, Site: 3}}, Name: "ann"},
+	{Type: Presence, Site: 3},
+	{Type: Disconnect, Site: 2},
+	{Type: Join, Site: 4, Addr: "10.0.0.4:7000"},
+	{Type: Members, Peers: []string{"10.0.0.1:7000", "10.0.0.4:7000"}},
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for v := MinVersion; v <= MaxVersion; v++ {
+		for _, m := range messages {
+			b, err := m.Marshal(v)
+			assert.NilError(t, err)
+			var got Message
+			assert.NilError(t, got.Unmarshal(b, v))
+			assert.DeepEqual(t, got, m)
+			if m.Type == Insert || m.Type == Delete || m.Type == Batch {
+				continue // operations have fields that may be missing, tested in document
+			}
+			short, _ := Message{Type: m.Type, Time: m.Time}.Marshal(v)
+			for i := range b {
+				if m.Type == Heartbeat && i == len(short) {
+					continue // a heartbeat of a peer that does not send its version
+				}
+				assert.Assert(t, got.Unmarshal(b[:i], v) != nil, "%d bytes of %v in version %d", i, m.Type, v)
+			}
+		}
+	}
+
+	// version 2 takes a byte for the small numbers of these identifiers, version 1 two
+	for _, m := range messages[3:6] {
+		b1, _ := m.Marshal(1)
+		b2, _ := m.Marshal(2)
+		assert.Assert(t, len(b2) < len(b1), "%v: %d bytes in version 2, %d in 1", m.Type, len(b2), len(b1))
+	}
+
+	_, err := Message{Type: Insert, Op: messages[4].Op}.MarshalBinary()
+	assert.ErrorContains(t, err, "another kind")
+	b, _ := messages[4].MarshalBinary()
+	b[0] = byte(Insert)
+	var m Message
+	assert.ErrorContains(t, m.UnmarshalBinary(b), "another kind")
+
+	// messages of later versions are passed on
+	assert.NilError(t, m.UnmarshalBinary([]byte{99, 1, 2, 3}))
+	assert.Equal(t, m.Type, MsgType(99))
+}
+
+// serve accepts a connection like a server that also speaks other protocols
+func serve(conn net.Conn, site uint8) chan *Conn {
+	accepted := make(chan *Conn, 1)
+	go func() {
+		r := bufio.NewReader(conn)
+		if !Sniff(r) {
+			conn.Close()
+			accepted <- nil
+			return
+		}
+		c, err := Accept(conn, r, site)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- c
+	}()
+	return accepted
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	accepted := serve(server, 1)
+	c, err := Connect(client, 2)
+	assert.NilError(t, err)
+	s := <-accepted
+	assert.Assert(t, s != nil)
+	assert.Equal(t, c.Version, MaxVersion)
+	assert.Equal(t, s.Version, MaxVersion)
+	assert.Equal(t, c.Site, uint8(1))
+	assert.Equal(t, s.Site, uint8(2))
+
+	go func() {
+		for _, m := range messages {
+			c.Send(m)
+		}
+		c.Close()
+	}()
+	for _, m := range messages {
+		got, err := s.Receive()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, got, m)
+	}
+	_, err = s.Receive()
+	assert.Assert(t, err != nil)
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	client, server := net.Pipe()
+	accepted := serve(server, 1)
+	c := &Conn{rw: client, r: bufio.NewReader(client)}
+	go func() {
+		client.Write([]byte(Magic))
+		c.Send(Message{Type: Hello, MinVersion: MaxVersion + 1, MaxVersion: MaxVersion + 2, Site: 2})
+	}()
+	m, err := c.Receive()
+	assert.NilError(t, err)
+	assert.Equal(t, m.Type, Error)
+	assert.Assert(t, <-accepted == nil)
+
+	// a newer client settles for our version
+	client, server = net.Pipe()
+	accepted = serve(server, 1)
+	c = &Conn{rw: client, r: bufio.NewReader(client)}
+	go func() {
+		client.Write([]byte(Magic))
+		c.Send(Message{Type: Hello, MinVersion: MinVersion, MaxVersion: MaxVersion + 5, Site: 2})
+	}()
+	m, err = c.Receive()
+	assert.NilError(t, err)
+	assert.Equal(t, m.Type, Welcome)
+	assert.Equal(t, m.Version, MaxVersion)
+	assert.Assert(t, <-accepted != nil)
+
+	// an older client gets version 1, and the encoding of version 1
+	client, server = net.Pipe()
+	accepted = serve(server, 1)
+	c = &Conn{rw: client, r: bufio.NewReader(client)}
+	go func() {
+		client.Write([]byte(Magic))
+		c.Send(Message{Type: Hello, MinVersion: 1, MaxVersion: 1, Site: 2})
+	}()
+	m, err = c.Receive()
+	assert.NilError(t, err)
+	assert.Equal(t, m.Version, 1)
+	s := <-accepted
+	assert.Equal(t, s.Version, 1)
+	presence := messages[9]
+	c.Version = m.Version
+	go c.Send(presence)
+	got, err := s.Receive()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, presence)
+}
+
+func TestSniffOtherProtocols(t *testing.T) {
+	client, server := net.Pipe()
+	accepted := serve(server, 1)
+	go client.Write([]byte("GET / HTTP/1.0\r\n"))
+	assert.Assert(t, <-accepted == nil)
+
+	_, err := Connect(client, 2)
+	assert.Assert(t, err != nil)
+}
@@ -0,0 +1,252 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/protocol"
+)
+
+// Faults describes how badly a Network delivers messages.
+type Faults struct {
+	Latency time.Duration // time every message takes
+	Jitter  time.Duration // random extra time, up to this, some messages take
+	Loss    float64       // probability that a message is lost
+	Reorder float64       // probability that a message is held back behind later ones
+}
+
+// ErrUnreachable is returned when dialing an address nobody listens at, or that a
+// partition cuts off.
+var ErrUnreachable = errors.New("transport: unreachable")
+
+// Network is an in-memory network that peers join with Node. Messages are encoded and
+// decoded on the way like on a real network, and suffer the faults of the network.
+type Network struct {
+	mu        sync.Mutex
+	rng       *rand.Rand
+	faults    Faults
+	listeners map[string]*memListener
+	group     map[string]int // side of the partition of every address, empty when healed
+}
+
+// NewNetwork returns a network without faults, that draws its faults from seed.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rng:       rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*memListener),
+		group:     make(map[string]int),
+	}
+}
+
+// SetFaults changes the faults of the network, for the messages sent from now on.
+func (n *Network) SetFaults(f Faults) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.faults = f
+}
+
+// Partition splits the network: peers in different groups cannot reach each other, and
+// the messages between them, including those on the way, are lost. Peers not in any
+// group are cut off from all.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[string]int)
+	for i, g := range groups {
+		for _, addr := range g {
+			n.group[addr] = i + 1
+		}
+	}
+}
+
+// Heal ends the partition.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[string]int)
+}
+
+// reachable reports whether a and b are on the same side of the partition. Callers hold
+// mu.
+func (n *Network) reachable(a, b string) bool {
+	if len(n.group) == 0 {
+		return true
+	}
+	ga, gb := n.group[a], n.group[b]
+	return ga != 0 && ga == gb
+}
+
+// Node returns the transport of the peer at addr, the address it listens at and that
+// partitions know it by.
+func (n *Network) Node(addr string) Transport {
+	return &memTransport{n: n, addr: addr}
+}
+
+type memTransport struct {
+	n    *Network
+	addr string
+}
+
+func (t *memTransport) Listen(addr string) (Listener, error) {
+	n := t.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if addr != t.addr {
+		return nil, errors.New("transport: " + t.addr + " cannot listen at " + addr)
+	}
+	if n.listeners[addr] != nil {
+		return nil, errors.New("transport: " + addr + " in use")
+	}
+	l := &memListener{n: n, addr: addr, conns: make(chan Conn, 16), done: make(chan struct{})}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+func (t *memTransport) Dial(addr string) (Conn, error) {
+	n := t.n
+	n.mu.Lock()
+	l := n.listeners[addr]
+	if l == nil || !n.reachable(t.addr, addr) {
+		n.mu.Unlock()
+		return nil, ErrUnreachable
+	}
+	local := &memConn{n: n, local: t.addr}
+	remote := &memConn{n: n, local: addr, peer: local}
+	local.peer = remote
+	local.ready = sync.NewCond(&n.mu)
+	remote.ready = sync.NewCond(&n.mu)
+	n.mu.Unlock()
+
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.done:
+		local.Close()
+		return nil, ErrUnreachable
+	}
+}
+
+type memListener struct {
+	n     *Network
+	addr  string
+	conns chan Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *memListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.n.mu.Lock()
+		delete(l.n.listeners, l.addr)
+		l.n.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() string {
+	return l.addr
+}
+
+// memConn is one end of a connection of a Network. Its fields are guarded by the mutex
+// of the network.
+type memConn struct {
+	n      *Network
+	local  string
+	peer   *memConn
+	queue  [][]byte // messages delivered and not received yet
+	ready  *sync.Cond
+	closed bool
+}
+
+func (c *memConn) Send(m protocol.Message) error {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	n := c.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	f := n.faults
+	if !n.reachable(c.local, c.peer.local) || n.rng.Float64() < f.Loss {
+		return nil // lost on the way, the sender cannot tell
+	}
+	delay := f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(n.rng.Int63n(int64(f.Jitter)))
+	}
+	if n.rng.Float64() < f.Reorder {
+		delay += 2*(f.Latency+f.Jitter) + time.Millisecond
+	}
+	peer := c.peer
+	if delay == 0 {
+		peer.deliver(b)
+		return nil
+	}
+	time.AfterFunc(delay, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.reachable(c.local, peer.local) {
+			peer.deliver(b)
+		}
+	})
+	return nil
+}
+
+// deliver queues a message for Receive. Callers hold the mutex of the network.
+func (c *memConn) deliver(b []byte) {
+	if !c.closed {
+		c.queue = append(c.queue, b)
+		c.ready.Signal()
+	}
+}
+
+func (c *memConn) Receive() (protocol.Message, error) {
+	c.n.mu.Lock()
+	for len(c.queue) == 0 && !c.closed {
+		c.ready.Wait()
+	}
+	if len(c.queue) == 0 {
+		c.n.mu.Unlock()
+		return protocol.Message{}, io.EOF
+	}
+	b := c.queue[0]
+	c.queue = c.queue[1:]
+	c.n.mu.Unlock()
+	var m protocol.Message
+	err := m.UnmarshalBinary(b)
+	return m, err
+}
+
+// Close closes both ends of the connection. The other end still receives the messages
+// delivered to it before.
+func (c *memConn) Close() error {
+	n := c.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c.queue = nil
+	for _, end := range []*memConn{c, c.peer} {
+		end.closed = true
+		end.ready.Broadcast()
+	}
+	return nil
+}
+
+func (c *memConn) RemoteAddr() string {
+	return c.peer.local
+}
@@ -0,0 +1,202 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/protocol"
+)
+
+// TCP is the transport of the framed protocol over TCP, or over TLS.
+type TCP struct {
+	Site uint8 // site ID sent in handshakes
+
+	// Legacy serves the accepted connections that do not speak the framed protocol,
+	// such as net/rpc ones. If it is nil, they are closed.
+	Legacy func(net.Conn)
+
+	// Timeout is how long connecting, a handshake or sending a message may take before
+	// the connection is given up, 0 for ever.
+	Timeout time.Duration
+
+	// TLS, if not nil, secures the connections, legacy ones included. When dialing
+	// without a ServerName, the host of the address is expected in the certificate.
+	TLS *tls.Config
+}
+
+// Dial connects to a peer and performs the handshake.
+func (t *TCP) Dial(addr string) (Conn, error) {
+	c, err := t.DialLegacy(addr)
+	if err != nil {
+		return nil, err
+	}
+	t.deadline(c)
+	pc, err := protocol.Connect(c, t.Site)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return &tcpConn{Conn: pc, nc: c, timeout: t.Timeout, addr: addr}, nil
+}
+
+// DialLegacy connects to a peer to speak another protocol with it, which its Legacy
+// serves.
+func (t *TCP) DialLegacy(addr string) (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", addr, t.Timeout)
+	if err != nil || t.TLS == nil {
+		return c, err
+	}
+	cfg := t.TLS
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(c, cfg)
+	t.deadline(tc)
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// deadline sets the deadline of what c does next, if there is a timeout.
+func (t *TCP) deadline(c net.Conn) {
+	if t.Timeout > 0 {
+		c.SetDeadline(time.Now().Add(t.Timeout))
+	}
+}
+
+// Listen listens at addr, a host:port pair. Handshakes happen in the background, so a
+// slow peer does not hold up the others.
+func (t *TCP) Listen(addr string) (Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tl := &tcpListener{t: t, l: l, conns: make(chan Conn), done: make(chan struct{})}
+	go tl.run()
+	return tl, nil
+}
+
+type tcpConn struct {
+	*protocol.Conn
+	nc      net.Conn
+	timeout time.Duration
+	addr    string
+}
+
+func (c *tcpConn) Send(m protocol.Message) error {
+	if c.timeout > 0 {
+		c.nc.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Send(m)
+}
+
+func (c *tcpConn) RemoteAddr() string { return c.addr }
+
+type tcpListener struct {
+	t     *TCP
+	l     net.Listener
+	conns chan Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// run accepts connections until the listener is closed. Other errors, such as running
+// out of file descriptors, pass, so it waits a little longer after each of them.
+func (tl *tcpListener) run() {
+	var wait time.Duration
+	for {
+		c, err := tl.l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			tl.once.Do(func() { close(tl.done) })
+			return
+		}
+		if err != nil {
+			if wait = 2 * wait; wait == 0 {
+				wait = 5 * time.Millisecond
+			} else if wait > time.Second {
+				wait = time.Second
+			}
+			log.Printf("accepting on %s failed, retrying in %v: %v", tl.Addr(), wait, err)
+			time.Sleep(wait)
+			continue
+		}
+		wait = 0
+		go tl.handshake(c)
+	}
+}
+
+// handshake hands a connection to Accept once it is set up, or to Legacy.
+func (tl *tcpListener) handshake(c net.Conn) {
+	if tl.t.TLS != nil {
+		tc := tls.Server(c, tl.t.TLS)
+		tl.t.deadline(tc)
+		if err := tc.Handshake(); err != nil {
+			log.Printf("TLS handshake with %s failed: %v", c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		c = tc
+	}
+	r := bufio.NewReader(c)
+	if !protocol.Sniff(r) { // net/rpc clients may stay quiet for long, no deadline here
+		if tl.t.Legacy != nil {
+			tl.t.Legacy(bufferedConn{c, r})
+		} else {
+			c.Close()
+		}
+		return
+	}
+	tl.t.deadline(c)
+	pc, err := protocol.Accept(c, r, tl.t.Site)
+	if err != nil {
+		log.Printf("handshake with %s failed: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	select {
+	case tl.conns <- &tcpConn{Conn: pc, nc: c, timeout: tl.t.Timeout, addr: c.RemoteAddr().String()}:
+	case <-tl.done:
+		c.Close()
+	}
+}
+
+func (tl *tcpListener) Accept() (Conn, error) {
+	select {
+	case c := <-tl.conns:
+		return c, nil
+	case <-tl.done:
+		return nil, ErrClosed
+	}
+}
+
+func (tl *tcpListener) Close() error {
+	err := tl.l.Close()
+	tl.once.Do(func() { close(tl.done) })
+	return err
+}
+
+func (tl *tcpListener) Addr() string {
+	return tl.l.Addr().String()
+}
+
+// bufferedConn is a connection whose first bytes were read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,47 @@
+// Package transport carries protocol messages between peers, over TCP or over an
+// in-memory network for tests.
+package transport
+
+import (
+	"errors"
+	"net"
+
+	"github.com/hesiyuan/EntangleText/protocol"
+)
+
+// Transport connects a peer to others.
+type Transport interface {
+	// Dial opens a connection to the peer listening at addr.
+	Dial(addr string) (Conn, error)
+	// Listen accepts connections from peers at addr.
+	Listen(addr string) (Listener, error)
+}
+
+// Conn is a connection between two peers. Send may be called from several goroutines at
+// once, Receive from one at a time.
+type Conn interface {
+	Send(m protocol.Message) error
+	// Receive waits for the next message. It returns an error once the connection is
+	// closed at either end.
+	Receive() (protocol.Message, error)
+	Close() error
+	// RemoteAddr returns the address of the other peer.
+	RemoteAddr() string
+}
+
+// Listener accepts connections from peers.
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+	// Addr returns the address peers dial to reach the listener.
+	Addr() string
+}
+
+// LegacyDialer is implemented by transports that also carry other protocols, such as
+// net/rpc, next to the framed one.
+type LegacyDialer interface {
+	DialLegacy(addr string) (net.Conn, error)
+}
+
+// ErrClosed is returned when using a connection or a listener that is closed.
+var ErrClosed = errors.New("transport: closed")
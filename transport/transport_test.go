@@ -0,0 +1,249 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/hesiyuan/EntangleText/protocol"
+	"gotest.tools/assert"
+)
+
+func heartbeat(i int) protocol.Message {
+	return protocol.Message{Type: protocol.Heartbeat, Time: int64(i)}
+}
+
+// connect dials b from a and returns both ends
+func connect(t *testing.T, a, b Transport, addr string) (Conn, Conn) {
+	l, err := b.Listen(addr)
+	assert.NilError(t, err)
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan Conn)
+	go func() {
+		c, err := l.Accept()
+		assert.Check(t, err)
+		accepted <- c
+	}()
+	c, err := a.Dial(l.Addr())
+	assert.NilError(t, err)
+	return c, <-accepted
+}
+
+// inbox receives the messages of c in the background
+func inbox(c Conn) chan int64 {
+	got := make(chan int64, 100)
+	go func() {
+		defer close(got)
+		for {
+			m, err := c.Receive()
+			if err != nil {
+				return
+			}
+			got <- m.Time
+		}
+	}()
+	return got
+}
+
+// receive takes up to n messages from an inbox, waiting a while for each
+func receive(got chan int64, n int) []int64 {
+	var times []int64
+	for len(times) < n {
+		select {
+		case t, ok := <-got:
+			if !ok {
+				return times
+			}
+			times = append(times, t)
+		case <-time.After(100 * time.Millisecond):
+			return times
+		}
+	}
+	return times
+}
+
+func send(t *testing.T, c Conn, n int) {
+	for i := 0; i < n; i++ {
+		assert.NilError(t, c.Send(heartbeat(i)))
+	}
+}
+
+func TestMemory(t *testing.T) {
+	n := NewNetwork(1)
+	a, b := connect(t, n.Node("a"), n.Node("b"), "b")
+	assert.Equal(t, a.RemoteAddr(), "b")
+	assert.Equal(t, b.RemoteAddr(), "a")
+	send(t, a, 3)
+	send(t, b, 1)
+	assert.DeepEqual(t, receive(inbox(b), 3), []int64{0, 1, 2})
+	assert.DeepEqual(t, receive(inbox(a), 1), []int64{0})
+
+	_, err := n.Node("a").Dial("c")
+	assert.Equal(t, err, ErrUnreachable)
+	_, err = n.Node("c").Listen("b")
+	assert.ErrorContains(t, err, "cannot listen")
+
+	a, b = connect(t, n.Node("a"), n.Node("d"), "d")
+	send(t, a, 2)
+	a.Close()
+	assert.Equal(t, a.Send(heartbeat(0)), ErrClosed)
+	assert.Equal(t, b.Send(heartbeat(0)), ErrClosed)
+	in := inbox(b)
+	assert.DeepEqual(t, receive(in, 3), []int64{0, 1}) // sent before the close
+	_, ok := <-in
+	assert.Assert(t, !ok)
+}
+
+func TestMemoryFaults(t *testing.T) {
+	n := NewNetwork(1)
+	a, b := connect(t, n.Node("a"), n.Node("b"), "b")
+	in := inbox(b)
+
+	n.SetFaults(Faults{Loss: 0.5})
+	send(t, a, 100)
+	lost := 100 - len(receive(in, 100))
+	assert.Assert(t, lost > 25 && lost < 75, "%d lost", lost)
+
+	n.SetFaults(Faults{Latency: time.Millisecond, Reorder: 0.3})
+	send(t, a, 50)
+	got := receive(in, 50)
+	assert.Equal(t, len(got), 50)
+	reordered := false
+	for i := 1; i < len(got); i++ {
+		reordered = reordered || got[i] < got[i-1]
+	}
+	assert.Assert(t, reordered)
+}
+
+func TestMemoryPartition(t *testing.T) {
+	n := NewNetwork(1)
+	a, b := connect(t, n.Node("a"), n.Node("b"), "b")
+	in := inbox(b)
+	n.SetFaults(Faults{Latency: 20 * time.Millisecond})
+	send(t, a, 1) // on the way when the partition happens
+	n.Partition([]string{"a"}, []string{"b", "c"})
+	send(t, a, 1)
+	assert.Equal(t, len(receive(in, 1)), 0)
+	_, err := n.Node("a").Dial("b")
+	assert.Equal(t, err, ErrUnreachable)
+
+	n.Heal()
+	send(t, a, 1)
+	assert.DeepEqual(t, receive(in, 1), []int64{0})
+}
+
+type Echo int
+
+func (Echo) Echo(s string, reply *string) error {
+	*reply = s
+	return nil
+}
+
+func TestTCP(t *testing.T) {
+	srv := rpc.NewServer()
+	assert.NilError(t, srv.Register(new(Echo)))
+	server := &TCP{Site: 1, Legacy: func(c net.Conn) { srv.ServeConn(c) }}
+	a, b := connect(t, &TCP{Site: 2}, server, "127.0.0.1:0")
+	in := inbox(b)
+	send(t, a, 3)
+	assert.DeepEqual(t, receive(in, 3), []int64{0, 1, 2})
+	send(t, b, 1)
+	assert.DeepEqual(t, receive(inbox(a), 1), []int64{0})
+	a.Close()
+	_, ok := <-in
+	assert.Assert(t, !ok) // closed at the other end
+
+	// legacy clients use the same port
+	l, err := server.Listen("127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+	client, err := rpc.Dial("tcp", l.Addr())
+	assert.NilError(t, err)
+	defer client.Close()
+	var reply string
+	assert.NilError(t, client.Call("Echo.Echo", "hi", &reply))
+	assert.Equal(t, reply, "hi")
+}
+
+func TestTCPTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close() // never answers the handshake
+		}
+	}()
+	start := time.Now()
+	_, err = (&TCP{Site: 1, Timeout: 50 * time.Millisecond}).Dial(l.Addr().String())
+	assert.ErrorContains(t, err, "timeout")
+	assert.Assert(t, time.Since(start) < time.Second)
+}
+
+// selfSigned returns a TLS configuration whose certificate, for 127.0.0.1, is the only
+// one trusted, on both sides
+func selfSigned(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func TestTCPTLS(t *testing.T) {
+	cfg := selfSigned(t)
+	srv := rpc.NewServer()
+	assert.NilError(t, srv.Register(new(Echo)))
+	server := &TCP{Site: 1, TLS: cfg, Legacy: func(c net.Conn) { srv.ServeConn(c) }, Timeout: time.Second}
+	client := &TCP{Site: 2, TLS: cfg, Timeout: time.Second}
+	a, b := connect(t, client, server, "127.0.0.1:0")
+	send(t, a, 2)
+	assert.DeepEqual(t, receive(inbox(b), 2), []int64{0, 1})
+
+	l, err := server.Listen("127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+	c, err := client.DialLegacy(l.Addr())
+	assert.NilError(t, err)
+	rc := rpc.NewClient(c)
+	defer rc.Close()
+	var reply string
+	assert.NilError(t, rc.Call("Echo.Echo", "hi", &reply))
+	assert.Equal(t, reply, "hi")
+
+	_, err = (&TCP{Site: 3, Timeout: time.Second}).Dial(l.Addr()) // without TLS
+	assert.Assert(t, err != nil)
+	_, err = (&TCP{Site: 3, TLS: &tls.Config{RootCAs: cfg.RootCAs}, Timeout: time.Second}).Dial(l.Addr())
+	assert.Assert(t, err != nil) // without a certificate
+}
@@ -0,0 +1,48 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// WriteSnapshot writes data to path along with its checksum. The file is replaced at
+// once, so a crash leaves either the old or the new snapshot.
+func WriteSnapshot(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // only there if something failed
+	if _, err := tmp.Write(frame(nil, data)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// ReadSnapshot returns the data of a snapshot written by WriteSnapshot, or ErrCorrupt
+// if it is damaged.
+func ReadSnapshot(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < headerSize || uint64(binary.BigEndian.Uint32(b[:4])) != uint64(len(b)-headerSize) ||
+		crc32.ChecksumIEEE(b[headerSize:]) != binary.BigEndian.Uint32(b[4:headerSize]) {
+		return nil, fmt.Errorf("%s: %w", path, ErrCorrupt)
+	}
+	return b[headerSize:], nil
+}
@@ -0,0 +1,262 @@
+// Package wal implements an append-only write-ahead log of opaque records.
+//
+// Every record is written as its length and CRC-32 checksum, 4 bytes each, big-endian,
+// followed by its bytes. A crash in the middle of an append leaves a truncated or
+// corrupted last record, which Open detects and cuts off.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MaxRecord is the size of the largest record accepted.
+const MaxRecord = 64 << 20
+
+const headerSize = 8
+
+// ErrCorrupt is returned by Open when a record other than the last one is damaged.
+// Such a log was not cut short by a crash and is not repaired automatically.
+var ErrCorrupt = errors.New("wal: corrupt record")
+
+// Options tunes a log.
+type Options struct {
+	// Sync makes Append return only once the record reached the disk. Without it, a
+	// crash of the machine, but not of the process, may lose the last records.
+	Sync bool
+}
+
+// Log is an open write-ahead log. It is not safe for concurrent use.
+type Log struct {
+	path string
+	f    *os.File
+	opts Options
+	size int64 // offset of the end of the last good record
+	buf  []byte
+}
+
+// Open opens the log at path, creating it if needed, and returns it along with the
+// records it holds, in the order they were appended. A damaged last record is ignored
+// and removed from the file.
+func Open(path string, opts Options) (*Log, [][]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, size, err := read(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &Log{path: path, f: f, opts: opts, size: size}, records, nil
+}
+
+// Read returns the records of the log at path without opening it for appending, so
+// it may be used while another process appends to it. A damaged last record is
+// ignored.
+func Read(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, _, err := read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, nil
+}
+
+// Report describes the state of a log, see Check.
+type Report struct {
+	Records int   // number of good records
+	Size    int64 // bytes taken by the good records
+	Torn    int64 // bytes of a damaged last record after them, cut off by the next Open
+}
+
+// Check reads the log at path without changing it and reports what Open would keep of
+// it. A damaged record other than the last one is returned as ErrCorrupt.
+func Check(path string) (Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Report{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Report{}, err
+	}
+	records, size, err := read(f)
+	if err != nil {
+		return Report{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return Report{Records: len(records), Size: size, Torn: info.Size() - size}, nil
+}
+
+// read reads every record of f and returns them with the offset where the good ones
+// end.
+func read(f *os.File) ([][]byte, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	r := bufio.NewReader(f)
+	var records [][]byte
+	var off int64
+	var h [headerSize]byte
+	for {
+		if _, err := io.ReadFull(r, h[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return records, off, nil // clean end, or a header cut short
+		} else if err != nil {
+			return nil, 0, err
+		}
+		n := binary.BigEndian.Uint32(h[:4])
+		end := off + headerSize + int64(n)
+		last := end >= info.Size()
+		if n > MaxRecord || end > info.Size() {
+			// a torn append or a damaged length: only the first has nothing after it
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !holdsRecord(rest) {
+				return records, off, nil
+			}
+			return nil, 0, fmt.Errorf("%w at offset %d", ErrCorrupt, off)
+		}
+		rec := make([]byte, n)
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(rec) != binary.BigEndian.Uint32(h[4:]) {
+			if last {
+				return records, off, nil
+			}
+			return nil, 0, fmt.Errorf("%w at offset %d", ErrCorrupt, off)
+		}
+		records = append(records, rec)
+		off = end
+	}
+}
+
+// holdsRecord reports whether a whole record starts anywhere in b. Empty records are
+// not counted, as zeros look like one.
+func holdsRecord(b []byte) bool {
+	for i := 0; i+headerSize <= len(b); i++ {
+		n := binary.BigEndian.Uint32(b[i:])
+		end := i + headerSize + int(n)
+		if n > 0 && n <= MaxRecord && end <= len(b) &&
+			crc32.ChecksumIEEE(b[i+headerSize:end]) == binary.BigEndian.Uint32(b[i+4:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Append adds a record at the end of the log.
+func (l *Log) Append(rec []byte) error {
+	if len(rec) > MaxRecord {
+		return fmt.Errorf("wal: record of %d bytes is too large", len(rec))
+	}
+	l.buf = frame(l.buf[:0], rec)
+	if _, err := l.f.Write(l.buf); err != nil {
+		// do not leave half a record behind for the next append
+		l.f.Truncate(l.size)
+		l.f.Seek(l.size, io.SeekStart)
+		return err
+	}
+	l.size += int64(len(l.buf))
+	if l.opts.Sync {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+// Size returns the size of the log in bytes.
+func (l *Log) Size() int64 {
+	return l.size
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// Compact drops the records before offset from, which must be the start of a record,
+// putting the head records in their place. It returns the new offset of the record
+// that was at from. The log is rewritten to a new file that replaces the old one at
+// once, so a crash leaves either of them.
+func (l *Log) Compact(head [][]byte, from int64) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".compact")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // only there if something failed
+	var start int64
+	for _, rec := range head {
+		b := frame(nil, rec)
+		if _, err := tmp.Write(b); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+		start += int64(len(b))
+	}
+	if _, err := io.Copy(tmp, io.NewSectionReader(l.f, from, l.size-from)); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := syncDir(l.path); err != nil { // or the rename may not survive a crash
+		tmp.Close()
+		return 0, err
+	}
+	l.f.Close()
+	l.f = tmp
+	l.size = start + l.size - from
+	_, err = l.f.Seek(l.size, io.SeekStart)
+	return start, err
+}
+
+// syncDir flushes the directory of path to disk, so that a file renamed there stays.
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// RecordSize returns the number of bytes the record takes in a log.
+func RecordSize(rec []byte) int64 {
+	return int64(headerSize + len(rec))
+}
+
+// frame appends the record with its header to b.
+func frame(b, rec []byte) []byte {
+	var h [headerSize]byte
+	binary.BigEndian.PutUint32(h[:4], uint32(len(rec)))
+	binary.BigEndian.PutUint32(h[4:], crc32.ChecksumIEEE(rec))
+	return append(append(b, h[:]...), rec...)
+}
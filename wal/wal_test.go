@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func write(t *testing.T, path string, records ...string) int64 {
+	l, _, err := Open(path, Options{Sync: true})
+	assert.NilError(t, err)
+	for _, r := range records {
+		assert.NilError(t, l.Append([]byte(r)))
+	}
+	size := l.Size()
+	assert.NilError(t, l.Close())
+	return size
+}
+
+func reopen(t *testing.T, path string) (*Log, []string) {
+	l, records, err := Open(path, Options{})
+	assert.NilError(t, err)
+	var s []string
+	for _, r := range records {
+		s = append(s, string(r))
+	}
+	return l, s
+}
+
+func TestAppendAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	write(t, path, "one", "", "three")
+	write(t, path, "four")
+
+	l, records := reopen(t, path)
+	defer l.Close()
+	assert.DeepEqual(t, records, []string{"one", "", "three", "four"})
+}
+
+func TestTruncatedLastRecordIsIgnored(t *testing.T) {
+	dir := t.TempDir()
+	full := filepath.Join(dir, "full")
+	good := write(t, full, "one", "two")
+	size := write(t, full, "three")
+	data, err := os.ReadFile(full)
+	assert.NilError(t, err)
+
+	// a crash may stop the last append anywhere
+	for cut := good; cut < size; cut++ {
+		path := filepath.Join(dir, "cut")
+		assert.NilError(t, os.WriteFile(path, data[:cut], 0644))
+		l, records := reopen(t, path)
+		assert.DeepEqual(t, records, []string{"one", "two"})
+		assert.Equal(t, l.Size(), good)
+
+		// appending after recovery does not keep the garbage around
+		assert.NilError(t, l.Append([]byte("four")))
+		assert.NilError(t, l.Close())
+		l, records = reopen(t, path)
+		assert.DeepEqual(t, records, []string{"one", "two", "four"})
+		assert.NilError(t, l.Close())
+	}
+}
+
+func TestCorruptRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	write(t, path, "one", "two", "three")
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+
+	// a damaged last record is what a torn write looks like
+	data[len(data)-1] ^= 0xff
+	assert.NilError(t, os.WriteFile(path, data, 0644))
+	l, records := reopen(t, path)
+	assert.DeepEqual(t, records, []string{"one", "two"})
+	assert.NilError(t, l.Close())
+
+	// a damaged record in the middle is not
+	write(t, path, "three")
+	data, err = os.ReadFile(path)
+	assert.NilError(t, err)
+	data[headerSize+1] ^= 0xff
+	assert.NilError(t, os.WriteFile(path, data, 0644))
+	_, _, err = Open(path, Options{})
+	assert.Assert(t, errors.Is(err, ErrCorrupt))
+
+	// nor is a damaged length that runs past the end, if records follow
+	data[headerSize+1] ^= 0xff
+	data[0] = 0x7f
+	assert.NilError(t, os.WriteFile(path, data, 0644))
+	_, _, err = Open(path, Options{})
+	assert.Assert(t, errors.Is(err, ErrCorrupt))
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Size(), int64(len(data))) // not truncated
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	size := write(t, path, "one", "two")
+	r, err := Check(path)
+	assert.NilError(t, err)
+	assert.Equal(t, r, Report{Records: 2, Size: size})
+
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(path, data[:size-1], 0644))
+	r, err = Check(path)
+	assert.NilError(t, err)
+	assert.Equal(t, r, Report{Records: 1, Size: size - RecordSize([]byte("two")), Torn: RecordSize([]byte("two")) - 1})
+
+	data[headerSize+1] ^= 0xff
+	assert.NilError(t, os.WriteFile(path, data, 0644))
+	_, err = Check(path)
+	assert.Assert(t, errors.Is(err, ErrCorrupt))
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	l, _, err := Open(path, Options{})
+	assert.NilError(t, err)
+	assert.NilError(t, l.Append([]byte("header")))
+	assert.NilError(t, l.Append([]byte("one")))
+	from := l.Size()
+	assert.NilError(t, l.Append([]byte("two")))
+	assert.NilError(t, l.Append([]byte("three")))
+
+	start, err := l.Compact([][]byte{[]byte("header")}, from)
+	assert.NilError(t, err)
+	assert.Equal(t, start, int64(headerSize+len("header")))
+	assert.NilError(t, l.Append([]byte("four")))
+	assert.NilError(t, l.Close())
+
+	l, records := reopen(t, path)
+	defer l.Close()
+	assert.DeepEqual(t, records, []string{"header", "two", "three", "four"})
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1) // no temporary file left behind
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snap")
+	assert.NilError(t, WriteSnapshot(path, []byte("old")))
+	assert.NilError(t, WriteSnapshot(path, []byte("state")))
+	data, err := ReadSnapshot(path)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "state")
+
+	b, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	for i := range b {
+		assert.NilError(t, os.WriteFile(path, b[:i], 0644))
+		_, err = ReadSnapshot(path)
+		assert.Assert(t, errors.Is(err, ErrCorrupt), "%d bytes", i)
+	}
+	b[len(b)-1] ^= 1
+	assert.NilError(t, os.WriteFile(path, b, 0644))
+	_, err = ReadSnapshot(path)
+	assert.Assert(t, errors.Is(err, ErrCorrupt))
+}